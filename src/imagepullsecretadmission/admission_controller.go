@@ -20,17 +20,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
-	"log"
+	"k8s.io/apimachinery/pkg/types"
 	"net/http"
+	"time"
 )
 
 const (
 	jsonContentType = `application/json`
+
+	admissionReviewKind = `AdmissionReview`
+	admissionV1beta1    = `admission.k8s.io/v1beta1`
+	admissionV1         = `admission.k8s.io/v1`
 )
 
 var (
@@ -44,58 +51,180 @@ type patchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
-// admitFunc is a callback for admission controller logic. Given an AdmissionRequest, it returns the sequence of patch
-// operations to be applied in case of success, or the error that will be shown when the operation is rejected.
-type admitFunc func(*v1beta1.AdmissionRequest, Config) ([]patchOperation, error)
+// admissionReview is the AdmissionReview wire format. admission.k8s.io/v1beta1 and admission.k8s.io/v1 only differ in
+// their apiVersion, so a single type is used to decode either version and to answer in the version that was received.
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *admissionRequest  `json:"request,omitempty"`
+	Response        *admissionResponse `json:"response,omitempty"`
+}
+
+// admissionRequest is the version-neutral view of an AdmissionRequest that is handed to an admitFunc.
+type admissionRequest struct {
+	UID         types.UID                   `json:"uid"`
+	Kind        metav1.GroupVersionKind     `json:"kind"`
+	Resource    metav1.GroupVersionResource `json:"resource"`
+	SubResource string                      `json:"subResource,omitempty"`
+	Name        string                      `json:"name,omitempty"`
+	Namespace   string                      `json:"namespace,omitempty"`
+	Operation   v1beta1.Operation           `json:"operation"`
+	UserInfo    authenticationv1.UserInfo   `json:"userInfo"`
+	Object      runtime.RawExtension        `json:"object,omitempty"`
+	OldObject   runtime.RawExtension        `json:"oldObject,omitempty"`
+	DryRun      *bool                       `json:"dryRun,omitempty"`
+}
+
+// admissionResponse is the version-neutral AdmissionResponse. The v1 API requires patchType to be set whenever a patch
+// is returned; v1beta1 accepts it as well. Warnings only exist in the v1 API.
+type admissionResponse struct {
+	UID              types.UID          `json:"uid"`
+	Allowed          bool               `json:"allowed"`
+	Result           *metav1.Status     `json:"status,omitempty"`
+	Patch            []byte             `json:"patch,omitempty"`
+	PatchType        *v1beta1.PatchType `json:"patchType,omitempty"`
+	AuditAnnotations map[string]string  `json:"auditAnnotations,omitempty"`
+	Warnings         []string           `json:"warnings,omitempty"`
+}
+
+// admitFunc is a callback for admission controller logic. Given an AdmissionRequest, it returns the admissionResult
+// with the patches, secret changes, audit annotations, warnings and report-only decision, and the error that will be
+// shown when the operation is rejected. The audit annotations of the result are also attached to a rejection.
+type admitFunc func(*admissionRequest, Config) (admissionResult, error)
 
+// admissionResult is what an admitFunc decided for an admitted object: the patches to apply, and which image pull
+// secrets they remove and add because of which rules. The audit annotations end up in the audit log of the cluster,
+// the warnings are shown to the user by kubectl.
+type admissionResult struct {
+	patches          []patchOperation
+	removedSecrets   []string
+	addedSecrets     []string
+	matchedRules     []string
+	auditAnnotations map[string]string
+	warnings         []string
+
+	// Set if the decision was only reported: the patches that would have been applied, or the denial
+	reportOnly bool
+	wouldPatch []patchOperation
+	wouldDeny  error
+}
+
+// reviewVersion returns the admission API version of the given review. Reviews without an apiVersion are treated as
+// v1beta1, which is what API servers sent before the v1 API existed.
+func reviewVersion(review *admissionReview) (string, error) {
+	if review.Kind != "" && review.Kind != admissionReviewKind {
+		return "", fmt.Errorf("unsupported kind %s, only %s is supported", review.Kind, admissionReviewKind)
+	}
+	switch review.APIVersion {
+	case "", admissionV1beta1:
+		return admissionV1beta1, nil
+	case admissionV1:
+		return admissionV1, nil
+	default:
+		return "", fmt.Errorf("unsupported apiVersion %s, only %s and %s are supported",
+			review.APIVersion, admissionV1, admissionV1beta1)
+	}
+}
+
+// admissionOutcome describes how a webhook request was handled, for logging and metrics. The request is nil if it
+// could not be parsed, and handled is only set once the decision of the admitFunc is ready to be sent. The body is the
+// AdmissionReview as it was received, for capture mode.
+type admissionOutcome struct {
+	request *admissionRequest
+	version string
+	body    []byte
+	handled bool
+	allowed bool
+	result  admissionResult
+	denial  error
+}
 
 // doServeAdmitFunc parses the HTTP request for an admission controller webhook, and -- in case of a well-formed
 // request -- delegates the admission control logic to the given admitFunc. The response body is then returned as raw
-// bytes.
-func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, config Config, admit admitFunc) ([]byte, error) {
+// bytes, along with the outcome of the request.
+func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, config Config, admit admitFunc) ([]byte, admissionOutcome, error) {
+	var outcome admissionOutcome
+
 	// Step 1: Request validation. Only handle POST requests with a body and json content type.
 
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		return nil, fmt.Errorf("invalid method %s, only POST requests are allowed", r.Method)
+		return nil, outcome, fmt.Errorf("invalid method %s, only POST requests are allowed", r.Method)
+	}
+
+	// The body is read up to one byte past the limit, so larger bodies are detected without reading them completely
+	limit := int64(config.Application.MaxRequestBytes)
+	if limit > 0 && r.ContentLength > limit {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil, outcome, fmt.Errorf("request body of %d bytes exceeds the limit of %d bytes", r.ContentLength, limit)
+	}
+	var reader io.Reader = r.Body
+	if limit > 0 {
+		reader = io.LimitReader(r.Body, limit+1)
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("could not read request body: %v", err)
+		return nil, outcome, fmt.Errorf("could not read request body: %v", err)
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil, outcome, fmt.Errorf("request body exceeds the limit of %d bytes", limit)
 	}
 
 	if contentType := r.Header.Get("Content-Type"); contentType != jsonContentType {
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
+		return nil, outcome, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
 	}
 
-	// Step 2: Parse the AdmissionReview request.
+	// Step 2: Parse the AdmissionReview request and determine the version to answer in.
+
+	var admissionReviewReq admissionReview
 
-	var admissionReviewReq v1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &admissionReviewReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, outcome, fmt.Errorf("could not deserialize request: %v", err)
+	}
 
-	if _, _, err := universalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
+	version, err := reviewVersion(&admissionReviewReq)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("could not deserialize request: %v", err)
+		return nil, outcome, err
+	}
 
+	if admissionReviewReq.Request == nil {
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, errors.New("malformed admission review: request is nil")
+		return nil, outcome, errors.New("malformed admission review: request is nil")
 	}
 
+	outcome.request = admissionReviewReq.Request
+	outcome.version = version
+	outcome.body = body
+
 	// Step 3: Construct the AdmissionReview response.
 
-	admissionReviewResponse := v1beta1.AdmissionReview{
-		Response: &v1beta1.AdmissionResponse{
+	admissionReviewResponse := admissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: version,
+			Kind:       admissionReviewKind,
+		},
+		Response: &admissionResponse{
 			UID: admissionReviewReq.Request.UID,
 		},
 	}
 
-	var patchOps []patchOperation
 	// Apply the admit() function
-	patchOps, err = admit(admissionReviewReq.Request, config)
+	result, err := admit(admissionReviewReq.Request, config)
+	patchOps := result.patches
+
+	// Explanations are attached to admitted and denied objects alike.
+	admissionReviewResponse.Response.AuditAnnotations = result.auditAnnotations
+	if version == admissionV1 {
+		admissionReviewResponse.Response.Warnings = result.warnings
+	}
 
 	if err != nil {
+		outcome.denial = err
 		// If the handler returned an error, incorporate the error message into the response and deny the object
 		// creation.
 		admissionReviewResponse.Response.Allowed = false
@@ -103,46 +232,105 @@ func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, config Config, adm
 			Message: err.Error(),
 		}
 	} else {
-		// Otherwise, encode the patch operations to JSON and return a positive response.
-		patchBytes, err := json.Marshal(patchOps)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
-		}
+		// Otherwise, encode the patch operations to JSON and return a positive response. The patch is only attached
+		// if there is something to patch, as the v1 API rejects a patch without a patchType.
 		admissionReviewResponse.Response.Allowed = true
-		admissionReviewResponse.Response.Patch = patchBytes
+		if len(patchOps) > 0 {
+			patchBytes, err := json.Marshal(patchOps)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return nil, outcome, fmt.Errorf("could not marshal JSON patch: %v", err)
+			}
+			patchType := v1beta1.PatchTypeJSONPatch
+			admissionReviewResponse.Response.Patch = patchBytes
+			admissionReviewResponse.Response.PatchType = &patchType
+		}
 	}
 
 	// Return the AdmissionReview with a response as JSON.
 	bytes, err := json.Marshal(&admissionReviewResponse)
 	if err != nil {
-		return nil, fmt.Errorf("marshaling response: %v", err)
+		return nil, outcome, fmt.Errorf("marshaling response: %v", err)
 	}
-	return bytes, nil
+
+	outcome.handled = true
+	outcome.allowed = admissionReviewResponse.Response.Allowed
+	outcome.result = result
+	return bytes, outcome, nil
 }
 
 // serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling and logging.
+// Every request ends with a summary line and is recorded in the metrics, labelled with the path it was sent to.
 func serveAdmitFunc(w http.ResponseWriter, r *http.Request, config Config, admit admitFunc) {
-	log.Print("Handling webhook request ...")
+	start := time.Now()
+
+	bytes, outcome, err := doServeAdmitFunc(w, r, config, admit)
+	duration := time.Since(start)
+	observeAdmission(r.URL.Path, outcome, duration)
+
+	reqLogger := logger.with(logFields{"endpoint": r.URL.Path})
+	if outcome.request != nil {
+		reqLogger = requestLogger(outcome.request).with(logFields{"endpoint": r.URL.Path})
+	}
 
 	var writeErr error
-	if bytes, err := doServeAdmitFunc(w, r, config, admit); err != nil {
-		log.Printf("Error handling webhook request: %v", err)
+	if err != nil {
+		reqLogger.log(levelError, logFields{"durationMs": durationMillis(duration), "error": err},
+			"Error handling webhook request")
 		w.WriteHeader(http.StatusInternalServerError)
 		_, writeErr = w.Write([]byte(err.Error()))
 	} else {
-		log.Print("Webhook request handled successfully")
+		reqLogger.log(levelInfo, summaryFields(outcome, duration), "Webhook request handled")
 		_, writeErr = w.Write(bytes)
+
+		if config.Application.CaptureDir != "" {
+			captures.add(pendingCapture{config: config, endpoint: r.URL.Path, outcome: outcome, response: bytes})
+		}
 	}
 
 	if writeErr != nil {
-		log.Printf("Could not write response: %v", writeErr)
+		reqLogger.Errorf("Could not write response: %v", writeErr)
+	}
+}
+
+// summaryFields describes the decision on a handled request for its summary log line.
+func summaryFields(outcome admissionOutcome, duration time.Duration) logFields {
+	fields := logFields{
+		"allowed":        outcome.allowed,
+		"removedSecrets": nonNil(outcome.result.removedSecrets),
+		"addedSecrets":   nonNil(outcome.result.addedSecrets),
+		"matchedRules":   nonNil(outcome.result.matchedRules),
+		"durationMs":     durationMillis(duration),
+	}
+	if outcome.denial != nil {
+		fields["denial"] = outcome.denial
+	}
+	if outcome.result.reportOnly {
+		fields["reportOnly"] = true
+		fields["wouldPatch"] = len(outcome.result.wouldPatch) > 0
+		if outcome.result.wouldDeny != nil {
+			fields["wouldDeny"] = outcome.result.wouldDeny
+		}
+	}
+	return fields
+}
+
+// nonNil returns an empty list instead of nil, so that it is logged as [] rather than null.
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
 	}
+	return values
+}
+
+func durationMillis(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
 }
 
 // admitFuncHandler takes an admitFunc and wraps it into a http.Handler by means of calling serveAdmitFunc.
-func admitFuncHandler(config Config, admit admitFunc) http.Handler {
+// Every request is handled with the config that is active when the request arrives.
+func admitFuncHandler(configs *configStore, admit admitFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		serveAdmitFunc(w, r, config, admit)
+		serveAdmitFunc(w, r, configs.Load(), admit)
 	})
 }
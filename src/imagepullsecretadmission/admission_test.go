@@ -1,45 +1,50 @@
 package main
 
 import (
-	"testing"
 	"encoding/json"
-	"k8s.io/api/admission/v1beta1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"reflect"
+	"testing"
 )
 
-
+// patchValue returns the JSON encoding of the value of a patch operation, as it will be sent to the API server.
+func patchValue(t *testing.T, op patchOperation) string {
+	bytes, err := json.Marshal(op.Value)
+	if err != nil {
+		t.Fatalf("Failed JSON marshal with %v", err)
+	}
+	return string(bytes)
+}
 
 func TestKubeSystemAdmission(t *testing.T) {
 
-
 	namespace := []string{"kube-system", "kube-public", "istio-system"}
 
 	config := defaultConfig
 
 	for _, ns := range namespace {
 		ns := ns
-		t.Run(ns, func(t *testing.T){
-			request := &v1beta1.AdmissionRequest {
-				UID:        "test-uid",
-				Namespace:  ns,
-				Resource:   podResource,
-				}
+		t.Run(ns, func(t *testing.T) {
+			request := &admissionRequest{
+				UID:       "test-uid",
+				Namespace: ns,
+				Resource:  podResource,
+			}
 
 			res, err := manageImagePullSecrets(request, config)
 			if err != nil {
 				t.Errorf("Error: Wanted nil, got %v", err)
 			}
 
-			if res != nil {
-				t.Errorf("Result: Wanted nil, got %v", res)
+			if res.patches != nil {
+				t.Errorf("Result: Wanted nil, got %v", res.patches)
 			}
 		})
 	}
 }
 
-
 func TestKubeNormalAdmission(t *testing.T) {
 	namespace := []string{"kube-nothing", "test-system", "testns"}
 
@@ -47,31 +52,31 @@ func TestKubeNormalAdmission(t *testing.T) {
 
 	for _, ns := range namespace {
 		ns := ns
-		t.Run(ns, func(t *testing.T){
+		t.Run(ns, func(t *testing.T) {
 			var raw runtime.RawExtension
-			jsonbytes, err := json.Marshal(corev1.Pod {
-				ObjectMeta: metav1.ObjectMeta {
+			jsonbytes, err := json.Marshal(corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
 					Namespace: ns,
 				},
-					Spec: corev1.PodSpec {
+				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
-						corev1.Container {
+						corev1.Container{
 							Image: "test",
-							},
-					},
+						},
 					},
-				})
+				},
+			})
 			if err != nil {
 				t.Fatalf("Failed JSON marshal with %v", err)
 			}
 
 			raw.UnmarshalJSON(jsonbytes)
 
-			request := &v1beta1.AdmissionRequest {
-				UID:        "test-uid",
-				Namespace:  ns,
-				Resource:   podResource,
-				Object:     raw,
+			request := &admissionRequest{
+				UID:       "test-uid",
+				Namespace: ns,
+				Resource:  podResource,
+				Object:    raw,
 			}
 
 			res, err := manageImagePullSecrets(request, config)
@@ -80,46 +85,129 @@ func TestKubeNormalAdmission(t *testing.T) {
 				t.Errorf("Error: Wanted nil, got %v", err)
 			}
 
-			if res == nil || len(res) != 2 {
-				t.Errorf("Result: Wanted patch result, got %v", res)
-			} else {
-				if res[0].Op != "add" || res[0].Path != "/spec/imagePullSecrets" || res[0].Value != "[]" {
-					t.Errorf("Result: Expected first patch to add empty imagePullSecrets array, got '%v'", res[0])
-				}
-				if res[1].Op != "add" || res[1].Path != "/spec/imagePullSecrets/-" || res[1].Value != "testSecret" {
-					t.Errorf("Result: Expected first patch to add empty imagePullSecrets array, got '%v'", res[0])
-				}
+			if res.patches == nil || len(res.patches) != 1 {
+				t.Errorf("Result: Wanted patch result, got %v", res.patches)
+			} else if res.patches[0].Op != "add" || res.patches[0].Path != "/spec/imagePullSecrets" ||
+				patchValue(t, res.patches[0]) != `[{"name":"testSecret"}]` {
+				t.Errorf("Result: Expected patch to add imagePullSecrets with testSecret, got '%v'", res.patches[0])
 			}
 		})
 	}
 }
 
-
-
 func TestKubeNotAPodAdmission(t *testing.T) {
 	namespace := []string{"kube-nothing", "test-system", "testns"}
 
 	config := defaultConfig
 
-
 	for _, ns := range namespace {
 		ns := ns
-		t.Run(ns, func(t *testing.T){
-			request := &v1beta1.AdmissionRequest {
-				UID:        "test-uid",
-					Namespace:  ns,
-					Resource: metav1.GroupVersionResource{Version: "v1", Resource: "services"},
-				}
+		t.Run(ns, func(t *testing.T) {
+			request := &admissionRequest{
+				UID:       "test-uid",
+				Namespace: ns,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "services"},
+			}
 
 			res, err := manageImagePullSecrets(request, config)
 			if err != nil {
 				t.Errorf("Error: Wanted nil, got %v", err)
 			}
 
-			if res != nil {
-				t.Errorf("Result: Wanted nil, got %v", res)
+			if res.patches != nil {
+				t.Errorf("Result: Wanted nil, got %v", res.patches)
+			}
+		})
+	}
+}
+
+func TestExplainSecretChanges(t *testing.T) {
+	result := admissionResult{removedSecrets: []string{"my-creds", "old-creds"}}
+	explainSecretChanges(&result, nil)
+
+	want := []string{
+		"imagePullSecret 'my-creds' was removed; managed secrets: none",
+		"imagePullSecret 'old-creds' was removed; managed secrets: none",
+	}
+	if !reflect.DeepEqual(result.warnings, want) {
+		t.Errorf("Warnings: Wanted %v, got %v", want, result.warnings)
+	}
+	if len(result.auditAnnotations) != 1 || result.auditAnnotations[auditRemovedSecrets] != `["my-creds","old-creds"]` {
+		t.Errorf("Audit annotations: Wanted only removed secrets, got %v", result.auditAnnotations)
+	}
+
+	unchanged := admissionResult{}
+	explainSecretChanges(&unchanged, []string{"testSecret"})
+	if unchanged.auditAnnotations != nil || unchanged.warnings != nil {
+		t.Errorf("Result: Wanted no explanations without changes, got %+v", unchanged)
+	}
+}
+
+func TestPatchSecretList(t *testing.T) {
+	tests := map[string]struct {
+		existing []string
+		desired  []string
+		want     []patchOperation
+	}{
+		"unchanged": {
+			existing: []string{"a", "b"},
+			desired:  []string{"a", "b"},
+			want:     nil,
+		},
+		"both empty": {
+			want: nil,
+		},
+		"remove all": {
+			existing: []string{"a", "b"},
+			want:     []patchOperation{{Op: "remove", Path: "/spec/imagePullSecrets"}},
+		},
+		"remove one": {
+			existing: []string{"a", "b", "c"},
+			desired:  []string{"a", "c"},
+			want:     []patchOperation{{Op: "remove", Path: "/spec/imagePullSecrets/1"}},
+		},
+		"append one": {
+			existing: []string{"a"},
+			desired:  []string{"a", "b"},
+			want:     []patchOperation{{Op: "add", Path: "/spec/imagePullSecrets/-", Value: secretReference("b")}},
+		},
+		"add list": {
+			desired: []string{"a", "b"},
+			want: []patchOperation{{Op: "add", Path: "/spec/imagePullSecrets",
+				Value: []corev1.LocalObjectReference{secretReference("a"), secretReference("b")}}},
+		},
+		"replace list": {
+			existing: []string{"user"},
+			desired:  []string{"a"},
+			want: []patchOperation{{Op: "replace", Path: "/spec/imagePullSecrets",
+				Value: []corev1.LocalObjectReference{secretReference("a")}}},
+		},
+		"reorder": {
+			existing: []string{"b", "a"},
+			desired:  []string{"a", "b"},
+			want: []patchOperation{{Op: "replace", Path: "/spec/imagePullSecrets",
+				Value: []corev1.LocalObjectReference{secretReference("a"), secretReference("b")}}},
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			got := patchSecretList("/spec", test.existing, test.desired)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Result: Wanted %v, got %v", test.want, got)
 			}
 		})
 	}
 }
 
+// A pod that already carries the managed secrets, e.g. on reinvocation, is left as it is
+func TestManagedSecretsReinvocation(t *testing.T) {
+	res, err := manageImagePullSecrets(podWithSecretsRequest(t, "testns", "testSecret"), defaultConfig)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if len(res.patches) != 0 || len(res.removedSecrets) != 0 || len(res.addedSecrets) != 0 || len(res.warnings) != 0 {
+		t.Errorf("Result: Wanted no changes, got %+v", res)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// Value of environment variables in captured requests, unless captureRedactEnv is disabled
+	redactedValue = "REDACTED"
+
+	// Captured reviews waiting to be written. Reviews captured while the queue is full are dropped, so that a slow
+	// disk does not hold up the responses of the webhook.
+	captureQueueSize = 100
+)
+
+// Characters that are replaced in the UID when it is used in a file name.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// capturedReview is a file written in capture mode: the AdmissionReview as it was received on the endpoint, and the
+// AdmissionReview that was sent back. The received review is kept as it is, with the fields of its API version that
+// the webhook does not read, like requestKind and options.
+type capturedReview struct {
+	Endpoint string          `json:"endpoint"`
+	Review   json.RawMessage `json:"review"`
+	Response json.RawMessage `json:"response"`
+}
+
+// pendingCapture is a handled request whose capture has not been written yet.
+type pendingCapture struct {
+	config   Config
+	endpoint string
+	outcome  admissionOutcome
+	response []byte
+}
+
+// captureQueue writes the captured reviews one at a time in the background, after the responses were sent.
+type captureQueue struct {
+	queue   chan pendingCapture
+	start   sync.Once
+	pending sync.WaitGroup
+}
+
+// The queue of the reviews captured by the webhooks.
+var captures = newCaptureQueue(captureQueueSize)
+
+func newCaptureQueue(size int) *captureQueue {
+	return &captureQueue{queue: make(chan pendingCapture, size)}
+}
+
+// add queues the review to be written, or drops and counts it if the queue is full.
+func (q *captureQueue) add(capture pendingCapture) {
+	q.start.Do(func() { go q.run() })
+	q.pending.Add(1)
+	select {
+	case q.queue <- capture:
+	default:
+		q.pending.Done()
+		captureDrops.add(1)
+	}
+}
+
+func (q *captureQueue) run() {
+	for capture := range q.queue {
+		if err := captureReview(capture.config, capture.endpoint, capture.outcome, capture.response); err != nil {
+			requestLogger(capture.outcome.request).with(logFields{"endpoint": capture.endpoint}).
+				Errorf("Could not capture webhook request: %v", err)
+		}
+		q.pending.Done()
+	}
+}
+
+// wait blocks until the queued reviews are written.
+func (q *captureQueue) wait() {
+	q.pending.Wait()
+}
+
+// captureReview writes the handled request and its response to the capture directory of the config. The file names
+// start with the time, so they are replayed in the order they were received.
+func captureReview(config Config, endpoint string, outcome admissionOutcome, response []byte) error {
+	review := outcome.body
+	if config.Application.CaptureRedactEnv {
+		var err error
+		if review, err = redactEnv(review); err != nil {
+			return err
+		}
+	}
+
+	captured, err := json.MarshalIndent(capturedReview{
+		Endpoint: endpoint,
+		Review:   review,
+		Response: response,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal captured review: %v", err)
+	}
+
+	name := fmt.Sprintf("%s-%s.json", time.Now().UTC().Format("20060102T150405.000000000"),
+		unsafeFileNameChars.ReplaceAllString(string(outcome.request.UID), "_"))
+	if err := ioutil.WriteFile(filepath.Join(config.Application.CaptureDir, name), captured, 0600); err != nil {
+		return fmt.Errorf("could not write captured review: %v", err)
+	}
+	return nil
+}
+
+// redactEnv replaces the values of all environment variables in the review, wherever a list of them appears, e.g. in
+// containers of pods and pod templates of the object and old object. References to secrets and config maps are kept.
+func redactEnv(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+
+	var object interface{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, fmt.Errorf("could not redact review: %v", err)
+	}
+	redactEnvValues(object)
+	return json.Marshal(object)
+}
+
+func redactEnvValues(node interface{}) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, child := range n {
+			if env, ok := child.([]interface{}); ok && key == "env" {
+				for _, variable := range env {
+					if variable, ok := variable.(map[string]interface{}); ok {
+						if _, ok := variable["value"]; ok {
+							variable["value"] = redactedValue
+						}
+					}
+				}
+				continue
+			}
+			redactEnvValues(child)
+		}
+	case []interface{}:
+		for _, child := range n {
+			redactEnvValues(child)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Builds an AdmissionRequest for a pod in testns with an environment variable
+// holding a password and a user-provided image pull secret.
+func envPodRequest(t *testing.T) *admissionRequest {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "testns"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Image: "test",
+				Env: []corev1.EnvVar{
+					{Name: "PASSWORD", Value: "hunter2"},
+					{Name: "TOKEN", ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{Key: "token"},
+					}},
+				},
+			}},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "my-creds"}},
+		},
+	}
+	return podRequest(t, pod)
+}
+
+// Captures a request to /mutate handled with the default rules in dir, and returns the captured file.
+func captureTestRequest(t *testing.T, dir string, redact bool) []byte {
+	config := mustCompile(Config{
+		Application:          Application{CaptureDir: dir, CaptureRedactEnv: redact},
+		ImagePullSecretRules: defaultConfig.ImagePullSecretRules,
+	})
+
+	// The fields of the v1 API that the webhook does not read are captured as well
+	body := strings.Replace(string(reviewBody(t, admissionV1, envPodRequest(t))), `"request":{`,
+		`"request":{"requestKind":{"group":"","version":"v1","kind":"Pod"},"options":{"kind":"CreateOptions"},`, 1)
+	req := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(body))
+	req.Header.Add("Content-Type", jsonContentType)
+	if recorder := makeRequest(req, config); recorder.Code != http.StatusOK {
+		t.Fatalf("Status: Wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+	captures.wait()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Result: Wanted a single captured file, got %v, %v", files, err)
+	}
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ipsa-capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCaptureRedaction(t *testing.T) {
+	tests := map[string]struct {
+		redact bool
+		want   string
+	}{
+		"redacted":     {redact: true, want: redactedValue},
+		"not redacted": {redact: false, want: "hunter2"},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			var captured capturedReview
+			if err := json.Unmarshal(captureTestRequest(t, dir, test.redact), &captured); err != nil {
+				t.Fatalf("Error: Wanted nil, got %v", err)
+			}
+			var review admissionReview
+			if err := json.Unmarshal(captured.Review, &review); err != nil {
+				t.Fatalf("Error: Wanted nil, got %v", err)
+			}
+			if captured.Endpoint != "/mutate" || review.APIVersion != admissionV1 {
+				t.Errorf("Result: Wanted v1 review captured on /mutate, got %s %s", captured.Endpoint, review.APIVersion)
+			}
+			if !strings.Contains(string(captured.Review), `"requestKind"`) || !strings.Contains(string(captured.Review), `"CreateOptions"`) {
+				t.Errorf("Result: Wanted requestKind and options captured, got %s", captured.Review)
+			}
+
+			pod, err := decodePod(review.Request.Object.Raw)
+			if err != nil {
+				t.Fatalf("Error: Wanted nil, got %v", err)
+			}
+			env := pod.Spec.Containers[0].Env
+			if env[0].Value != test.want || env[1].ValueFrom == nil || env[1].ValueFrom.SecretKeyRef.Key != "token" {
+				t.Errorf("Result: Wanted value %s and kept secret reference, got %+v", test.want, env)
+			}
+			if !strings.Contains(string(captured.Response), `"patch"`) {
+				t.Errorf("Result: Wanted captured response with patch, got %s", captured.Response)
+			}
+		})
+	}
+}
+
+// Reviews captured while the queue is full are dropped instead of holding up the response
+func TestCaptureQueueFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	config := mustCompile(Config{Application: Application{CaptureDir: dir}})
+	request := envPodRequest(t)
+	outcome := admissionOutcome{request: request, version: admissionV1, body: reviewBody(t, admissionV1, request)}
+
+	queue := newCaptureQueue(1)
+	// Nothing is written until the queue runs
+	queue.start.Do(func() {})
+	drops := counterValue(captureDrops)
+	queue.add(pendingCapture{config: config, endpoint: "/mutate", outcome: outcome})
+	queue.add(pendingCapture{config: config, endpoint: "/mutate", outcome: outcome})
+	if diff := counterValue(captureDrops) - drops; diff != 1 {
+		t.Errorf("Metric: Wanted 1 dropped capture, got %v", diff)
+	}
+
+	go queue.run()
+	queue.wait()
+	if files, err := filepath.Glob(filepath.Join(dir, "*.json")); err != nil || len(files) != 1 {
+		t.Errorf("Result: Wanted the queued capture written, got %v, %v", files, err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	captureTestRequest(t, dir, true)
+
+	configs := map[string]struct {
+		config  string
+		changed bool
+		want    string
+	}{
+		"unchanged": {config: validConfigYAML, want: "Replayed 1 requests, 0 changed"},
+		"patch changed": {
+			config:  updatedConfigYAML,
+			changed: true,
+			want:    "/mutate CREATE pods testns/app (uid test-uid)\n  patch:\n",
+		},
+	}
+
+	for name, test := range configs {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			configPath := filepath.Join(tempDir(t), "config.yaml")
+			defer os.RemoveAll(filepath.Dir(configPath))
+			if err := ioutil.WriteFile(configPath, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			err := runReplay([]string{"-config", configPath, dir}, nil, &out)
+			if (err != nil) != test.changed {
+				t.Errorf("Error: Wanted error %t, got %v", test.changed, err)
+			}
+			if !strings.Contains(out.String(), test.want) {
+				t.Errorf("Result: Wanted output containing %q, got\n%s", test.want, out.String())
+			}
+		})
+	}
+}
+
+func TestDescribeResponseChange(t *testing.T) {
+	req := envPodRequest(t)
+	before := &admissionResponse{Allowed: true, Patch: []byte(`[{"op": "remove", "path": "/spec/imagePullSecrets"}]`)}
+
+	same := &admissionResponse{Allowed: true, Patch: []byte(`[{"path":"/spec/imagePullSecrets","op":"remove"}]`)}
+	if diff, err := describeResponseChange("/mutate", req, before, same); err != nil || diff != "" {
+		t.Errorf("Reformatted patch: Wanted no change, got %q, %v", diff, err)
+	}
+
+	denied := &admissionResponse{Allowed: false, Result: &metav1.Status{Message: "images not allowed"}}
+	diff, err := describeResponseChange("/mutate", req, before, denied)
+	if err != nil || !strings.Contains(diff, "allowed: true -> false: images not allowed") ||
+		!strings.Contains(diff, "+ none") {
+		t.Errorf("Denied: Wanted changed decision and patch, got %q, %v", diff, err)
+	}
+}
@@ -0,0 +1,466 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// The CA bundle is written next to the serving certificate
+	caCertFile = `ca.crt`
+
+	certValidity = 365 * 24 * time.Hour
+	// Certificates are replaced once less than this is left of their validity
+	certRotateBefore = 30 * 24 * time.Hour
+	// How often self-managed certificates are checked for rotation
+	certRotationInterval = time.Hour
+)
+
+// certManager generates a CA and a serving certificate signed by it, and replaces both before they expire. The CA bundle is published to the webhook configurations before a new serving certificate is written, so
+// the API server trusts it as soon as it is served.
+type certManager struct {
+	certPath     string
+	keyPath      string
+	caPath       string
+	dnsNames     []string
+	validity     time.Duration
+	rotateBefore time.Duration
+
+	// The MutatingWebhookConfiguration and ValidatingWebhookConfiguration whose caBundle is updated.
+	// Nothing is published without a client.
+	webhookConfiguration string
+	client               webhookClient
+
+	published bool
+}
+
+func newCertManager(certPath string, keyPath string, service string, namespace string) *certManager {
+	return &certManager{
+		certPath:     certPath,
+		keyPath:      keyPath,
+		caPath:       filepath.Join(filepath.Dir(certPath), caCertFile),
+		dnsNames:     serviceDNSNames(service, namespace),
+		validity:     certValidity,
+		rotateBefore: certRotateBefore,
+	}
+}
+
+// serviceDNSNames returns the names a service is reached by in the cluster. The API server calls webhooks on
+// service.namespace.svc.
+func serviceDNSNames(service string, namespace string) []string {
+	return []string{
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc.cluster.local",
+		service + "." + namespace,
+		service,
+	}
+}
+
+// parseCertService splits the certService setting into the name and namespace of the service.
+func parseCertService(value string) (string, string, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q is not of the form name.namespace", value)
+	}
+	return parts[0], parts[1], nil
+}
+
+// Checks the certificates every interval until stop is closed.
+func (m *certManager) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := m.check(time.Now()); err != nil {
+				logger.Errorf("Certificate rotation failed, keeping the active certificates: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// check rotates the certificates if they are missing, invalid or about to expire, and publishes the CA bundle
+// if it was not published yet. It returns whether the certificates were rotated.
+func (m *certManager) check(now time.Time) (bool, error) {
+	if err := m.validate(now); err != nil {
+		logger.Infof("Rotating certificate %s: %v", m.certPath, err)
+		if err := m.rotate(now); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if !m.published {
+		if err := m.publish(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Returns why the serving certificate has to be replaced, or nil if it is valid for the service
+// and the CA bundle for long enough.
+func (m *certManager) validate(now time.Time) error {
+	certPEM, err := ioutil.ReadFile(m.certPath)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(m.keyPath)
+	if err != nil {
+		return err
+	}
+	cert, err := parseKeyPair(certPEM, keyPEM, now)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := ioutil.ReadFile(m.caPath)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(bundle)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: m.dnsNames[0], Roots: roots, CurrentTime: now}); err != nil {
+		return err
+	}
+
+	if expiry := cert.Leaf.NotAfter; expiry.Sub(now) < m.rotateBefore {
+		return fmt.Errorf("certificate expires at %s", expiry.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Generates a new CA and serving certificate. The CA bundle keeps the CA of the current serving certificate, so
+// replicas still serving it stay trusted until they have loaded the new one.
+func (m *certManager) rotate(now time.Time) error {
+	caPEM, certPEM, keyPEM, err := generateCertificates(m.dnsNames, m.validity, now)
+	if err != nil {
+		return err
+	}
+
+	bundle := append(caPEM, m.currentCA(now)...)
+	if err := writeFileAtomic(m.caPath, bundle, 0644); err != nil {
+		return err
+	}
+	if err := m.publish(); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(m.keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(m.certPath, certPEM, 0644)
+}
+
+// Returns the PEM encoded CA from the bundle that signed the current serving certificate, if it
+// is still valid.
+func (m *certManager) currentCA(now time.Time) []byte {
+	certPEM, err := ioutil.ReadFile(m.certPath)
+	if err != nil {
+		return nil
+	}
+	bundle, err := ioutil.ReadFile(m.caPath)
+	if err != nil {
+		return nil
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err == nil && now.Before(ca.NotAfter) && leaf.CheckSignatureFrom(ca) == nil {
+			return pem.EncodeToMemory(block)
+		}
+	}
+	return nil
+}
+
+// Sets the CA bundle as caBundle of the webhook configurations. Either of them may not exist.
+func (m *certManager) publish() error {
+	if m.client == nil || m.webhookConfiguration == "" {
+		m.published = true
+		return nil
+	}
+
+	bundle, err := ioutil.ReadFile(m.caPath)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, resource := range webhookConfigurationResources {
+		err := m.client.SetCABundle(resource, m.webhookConfiguration, bundle)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not update caBundle of %s %s: %v", resource, m.webhookConfiguration, err)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("no webhook configuration named %s", m.webhookConfiguration)
+	}
+
+	m.published = true
+	logger.Infof("caBundle of webhook configuration %s updated", m.webhookConfiguration)
+	return nil
+}
+
+// generateCertificates returns a new self-signed CA, and a serving certificate signed by it for the DNS names along
+// with its key, all PEM encoded.
+func generateCertificates(dnsNames []string, validity time.Duration, now time.Time) ([]byte, []byte, []byte, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          randomSerialNumber(),
+		Subject:               pkix.Name{CommonName: "Image Pull Secret Admission Webhook CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		nil
+}
+
+func randomSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+// writeFileAtomic replaces the file by renaming a complete copy over it, so the key pair reloader never reads a
+// partially written file.
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// setManifestCABundle sets the caBundle of all webhooks of the webhook configurations in a multi-document YAML
+// manifest. The other documents are kept as they are, apart from formatting.
+func setManifestCABundle(manifest []byte, bundle []byte) ([]byte, error) {
+	caBundle := base64.StdEncoding.EncodeToString(bundle)
+
+	var out bytes.Buffer
+	decoder := yaml.NewDecoder(bytes.NewReader(manifest))
+	for {
+		var document yaml.MapSlice
+		if err := decoder.Decode(&document); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse manifest: %v", err)
+		}
+		if len(document) == 0 {
+			continue
+		}
+
+		if kind := mapSliceValue(document, "kind"); kind == "MutatingWebhookConfiguration" ||
+			kind == "ValidatingWebhookConfiguration" {
+			webhooks, _ := mapSliceValue(document, "webhooks").([]interface{})
+			for i, webhook := range webhooks {
+				if webhook, ok := webhook.(yaml.MapSlice); ok {
+					clientConfig, _ := mapSliceValue(webhook, "clientConfig").(yaml.MapSlice)
+					webhooks[i] = setMapSliceValue(webhook, "clientConfig",
+						setMapSliceValue(clientConfig, "caBundle", caBundle))
+				}
+			}
+		}
+
+		encoded, err := yaml.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		if out.Len() > 0 {
+			out.WriteString("---\n")
+		}
+		out.Write(encoded)
+	}
+	return out.Bytes(), nil
+}
+
+func mapSliceValue(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// Returns the map with the key set to the value, appended if the key is new.
+func setMapSliceValue(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key == key {
+			m[i].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
+
+// runCerts generates the CA and serving certificate into a directory unless it already has valid ones, and prints
+// the caBundle for the webhook configurations, or the manifest with the caBundle set. Run regularly, it rotates the
+// certificates before they expire.
+func runCerts(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("certs", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "directory to write "+caCertFile+", "+tlsCertFile+" and "+tlsKeyFile+" to")
+	service := flags.String("service", defaultApplication.CertService, "name.namespace of the service the webhook is served by")
+	validity := flags.Duration("validity", certValidity, "validity of generated certificates")
+	rotateBefore := flags.Duration("rotate-before", certRotateBefore,
+		"replace certificates that expire within this duration")
+	manifestPath := flags.String("manifest", "", "manifest to print with the caBundle of its webhook configurations set")
+	webhookConfiguration := flags.String("webhook-configuration", "",
+		"update the caBundle of the webhook configurations with this name, from within the cluster")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	name, namespace, err := parseCertService(*service)
+	if err != nil {
+		return err
+	}
+	manager := newCertManager(filepath.Join(*dir, tlsCertFile), filepath.Join(*dir, tlsKeyFile), name, namespace)
+	manager.validity = *validity
+	manager.rotateBefore = *rotateBefore
+	if *webhookConfiguration != "" {
+		if manager.client, err = newWebhookClient(); err != nil {
+			return err
+		}
+		manager.webhookConfiguration = *webhookConfiguration
+	}
+
+	if _, err := manager.check(time.Now()); err != nil {
+		return err
+	}
+
+	bundle, err := ioutil.ReadFile(manager.caPath)
+	if err != nil {
+		return err
+	}
+	if *manifestPath == "" {
+		_, err := fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(bundle))
+		return err
+	}
+
+	manifest, err := ioutil.ReadFile(*manifestPath)
+	if err != nil {
+		return err
+	}
+	if manifest, err = setManifestCABundle(manifest, bundle); err != nil {
+		return err
+	}
+	_, err = stdout.Write(manifest)
+	return err
+}
+
+// startCertManager generates the serving certificate if the config asks for self-managed certificates, and keeps
+// rotating it until stop is closed.
+func startCertManager(config Config, stop <-chan struct{}) error {
+	settings := config.Application
+	if !settings.SelfManagedCerts {
+		return nil
+	}
+
+	manager := newCertManager(settings.TLSCertFile, settings.TLSKeyFile, config.certService, config.certNamespace)
+	if settings.WebhookConfiguration != "" {
+		client, err := newWebhookClient()
+		if err != nil {
+			return err
+		}
+		manager.client, manager.webhookConfiguration = client, settings.WebhookConfiguration
+	}
+
+	if _, err := manager.check(time.Now()); err != nil {
+		return err
+	}
+	go manager.run(certRotationInterval, stop)
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeWebhookClient records the CA bundles set on the webhook configurations that exist.
+type fakeWebhookClient struct {
+	existing map[string]bool
+	err      error
+	bundles  map[string][]byte
+}
+
+func (c *fakeWebhookClient) SetCABundle(resource string, name string, caBundle []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	if !c.existing[resource+"/"+name] {
+		return errNotFound
+	}
+	c.bundles[resource+"/"+name] = caBundle
+	return nil
+}
+
+func newFakeWebhookClient(existing ...string) *fakeWebhookClient {
+	client := &fakeWebhookClient{existing: map[string]bool{}, bundles: map[string][]byte{}}
+	for _, name := range existing {
+		client.existing[name] = true
+	}
+	return client
+}
+
+// Returns the certificates of a PEM bundle.
+func parseBundle(t *testing.T, bundle []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+func TestCertManager(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newFakeWebhookClient("mutatingwebhookconfigurations/demo-webhook")
+	manager := newCertManager(filepath.Join(dir, tlsCertFile), filepath.Join(dir, tlsKeyFile), "webhook-server", "webhook-demo")
+	manager.client, manager.webhookConfiguration = client, "demo-webhook"
+
+	now := time.Now()
+	if rotated, err := manager.check(now); err != nil || !rotated {
+		t.Fatalf("Initial: Wanted rotated, got %t, %v", rotated, err)
+	}
+	first, err := ioutil.ReadFile(filepath.Join(dir, caCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published := client.bundles["mutatingwebhookconfigurations/demo-webhook"]; !bytes.Equal(published, first) {
+		t.Errorf("Published: Wanted %s, got %s", first, published)
+	}
+	if err := manager.validate(now); err != nil {
+		t.Errorf("Error: Wanted valid certificates, got %v", err)
+	}
+
+	if rotated, err := manager.check(now.Add(time.Hour)); err != nil || rotated {
+		t.Errorf("Valid: Wanted no rotation, got %t, %v", rotated, err)
+	}
+
+	// Shortly before expiry both CAs are trusted until the new certificate is served everywhere
+	later := now.Add(certValidity - certRotateBefore + time.Hour)
+	if rotated, err := manager.check(later); err != nil || !rotated {
+		t.Fatalf("Expiring: Wanted rotated, got %t, %v", rotated, err)
+	}
+	bundle := parseBundle(t, client.bundles["mutatingwebhookconfigurations/demo-webhook"])
+	if len(bundle) != 2 || !bytes.Equal(bundle[1].Raw, parseBundle(t, first)[0].Raw) {
+		t.Errorf("Result: Wanted new and previous CA, got %d certificates", len(bundle))
+	}
+	if err := manager.validate(later); err != nil {
+		t.Errorf("Error: Wanted valid rotated certificates, got %v", err)
+	}
+}
+
+func TestCertManagerPublishFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	clients := map[string]*fakeWebhookClient{
+		"api error": {err: errors.New("forbidden")},
+		"not found": newFakeWebhookClient(),
+	}
+	for name, client := range clients {
+		client := client
+		t.Run(name, func(t *testing.T) {
+			manager := newCertManager(filepath.Join(dir, tlsCertFile), filepath.Join(dir, tlsKeyFile), "webhook-server", "webhook-demo")
+			manager.client, manager.webhookConfiguration = client, "demo-webhook"
+			if _, err := manager.check(time.Now()); err == nil {
+				t.Errorf("Error: Wanted error, got nil")
+			}
+			// The API server would not trust a new serving certificate
+			if _, err := os.Stat(filepath.Join(dir, tlsCertFile)); !os.IsNotExist(err) {
+				t.Errorf("Result: Wanted no serving certificate, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCertManagerServiceChanged(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := newCertManager(filepath.Join(dir, tlsCertFile), filepath.Join(dir, tlsKeyFile), "webhook-server", "webhook-demo").check(time.Now()); err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if rotated, err := newCertManager(filepath.Join(dir, tlsCertFile), filepath.Join(dir, tlsKeyFile), "ipsa", "webhook-demo").check(time.Now()); err != nil || !rotated {
+		t.Errorf("Result: Wanted rotation for the new service, got %t, %v", rotated, err)
+	}
+}
+
+func TestSetManifestCABundle(t *testing.T) {
+	template, err := ioutil.ReadFile("tools/deployment/deployment.yaml.template")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := setManifestCABundle(template, []byte("test-ca"))
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+
+	var kinds []string
+	decoder := yaml.NewDecoder(bytes.NewReader(manifest))
+	for {
+		var document struct {
+			Kind     string `yaml:"kind"`
+			Webhooks []struct {
+				ClientConfig struct {
+					CABundle string `yaml:"caBundle"`
+				} `yaml:"clientConfig"`
+			} `yaml:"webhooks"`
+		}
+		if err := decoder.Decode(&document); err != nil {
+			break
+		}
+		kinds = append(kinds, document.Kind)
+		for _, webhook := range document.Webhooks {
+			if webhook.ClientConfig.CABundle != base64.StdEncoding.EncodeToString([]byte("test-ca")) {
+				t.Errorf("%s: Wanted caBundle set, got %q", document.Kind, webhook.ClientConfig.CABundle)
+			}
+		}
+	}
+
+	want := "Deployment ConfigMap Service ServiceAccount ClusterRole ClusterRoleBinding MutatingWebhookConfiguration " +
+		"ValidatingWebhookConfiguration"
+	if strings.Join(kinds, " ") != want {
+		t.Errorf("Result: Wanted documents %s, got %v", want, kinds)
+	}
+}
+
+func TestRunCerts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var first, second bytes.Buffer
+	if err := runCerts([]string{"-dir", dir}, nil, &first); err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if err := runCerts([]string{"-dir", dir}, nil, &second); err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("Result: Wanted valid certificates to be kept, got %s and %s", first.String(), second.String())
+	}
+
+	bundle, err := base64.StdEncoding.DecodeString(strings.TrimSpace(first.String()))
+	if err != nil || len(parseBundle(t, bundle)) != 1 {
+		t.Errorf("Result: Wanted base64 CA bundle, got %s, %v", first.String(), err)
+	}
+
+	var out bytes.Buffer
+	err = runCerts([]string{"-dir", dir, "-manifest", "tools/deployment/deployment.yaml.template"}, nil, &out)
+	if err != nil || !strings.Contains(out.String(), "caBundle: "+strings.TrimSpace(first.String())) {
+		t.Errorf("Result: Wanted manifest with caBundle, got %v\n%s", err, out.String())
+	}
+
+	if err := runCerts([]string{"-dir", dir, "-service", "webhook-server"}, nil, &out); err == nil {
+		t.Errorf("Invalid service: Wanted error, got nil")
+	}
+}
+
+func TestAPIServerClient(t *testing.T) {
+	var patch []patchOperation
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path != "/apis/admissionregistration.k8s.io/v1/mutatingwebhookconfigurations/demo-webhook":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`{"webhooks": [{"name": "a"}, {"name": "b"}]}`))
+		case r.Method == http.MethodPatch && r.Header.Get("Content-Type") == jsonPatchContentType:
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	client := &apiServerClient{host: server.URL, token: "test-token", client: server.Client()}
+	if err := client.SetCABundle("mutatingwebhookconfigurations", "demo-webhook", []byte("test-ca")); err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if len(patch) != 2 || patch[1].Path != "/webhooks/1/clientConfig/caBundle" ||
+		patch[1].Value != base64.StdEncoding.EncodeToString([]byte("test-ca")) {
+		t.Errorf("Result: Wanted caBundle of both webhooks set, got %+v", patch)
+	}
+
+	err := client.SetCABundle("validatingwebhookconfigurations", "demo-webhook", []byte("test-ca"))
+	if err != errNotFound {
+		t.Errorf("Error: Wanted %v, got %v", errNotFound, err)
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Config struct {
+	Application          Application                      `yaml:"application,omitempty"`
+	ImagePullSecretRules map[string]map[string]secretList `yaml:"imagePullSecretRules"`
+	ImageAdmissionRules  map[string][]ImageMatcher        `yaml:"imageAdmissionRules,omitempty"`
+	ExcludedNamespaces   []NamespaceExclusion             `yaml:"excludedNamespaces,omitempty"`
+	PreserveOverride     PreserveOverride                 `yaml:"preserveImagePullSecrets,omitempty"`
+	Rules                []ImagePullSecretRule            `yaml:"rules,omitempty"`
+	SecretSets           map[string][]string              `yaml:"secretSets,omitempty"`
+	ReportOnly           ReportOnly                       `yaml:"reportOnly,omitempty"`
+	UserSecretPolicies   []UserSecretPolicy               `yaml:"userSecretPolicies,omitempty"`
+
+	// Compiled from the rules above by compile()
+	secretRules    []secretRule
+	admissionRules []admissionRule
+	logLevel       logLevel
+	certService    string
+	certNamespace  string
+}
+
+// admissionRule is a compiled entry of ImageAdmissionRules.
+type admissionRule struct {
+	namespace *regexp.Regexp
+	images    []imageMatcher
+}
+
+// configErrors collects every problem found in a config, each prefixed with
+// its path in the YAML document, so that all of them can be fixed at once.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return fmt.Sprintf("%d error(s) in config:\n  %s", len(e), strings.Join(e, "\n  "))
+}
+
+func (e *configErrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, path+": "+fmt.Sprintf(format, args...))
+}
+
+// Compiles the regex, or records the error and returns nil.
+func (e *configErrors) regexp(path string, expr string) *regexp.Regexp {
+	compiled, err := regexp.Compile(expr)
+	if err != nil {
+		e.add(path, "invalid regex: %v", err)
+		return nil
+	}
+	return compiled
+}
+
+// Reads, parses and validates the config file. Besides the config, the
+// checksum of the file content is returned to detect changes later on.
+func loadConfigFile(path string) (Config, []byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, nil, err
+	}
+	checksum := sha256.Sum256(content)
+
+	config, err := parseConfig(content)
+	return config, checksum[:], err
+}
+
+// Parses the YAML config strictly, i.e. unknown fields are errors, and compiles it.
+// Type errors do not stop the validation, they are reported along with all
+// other problems of the config. Settings missing in the application section
+// are defaulted, and the settings given by environment variables and flags
+// override the config.
+func parseConfig(content []byte) (Config, error) {
+	config := Config{Application: defaultApplication}
+	var errs configErrors
+
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return Config{}, fmt.Errorf("could not parse config: %v", err)
+		}
+		for _, message := range typeErr.Errors {
+			errs = append(errs, yamlErrorPath(content, message))
+		}
+	}
+	// An application section without settings is null, which zeroes all of them
+	if config.Application == (Application{}) {
+		config.Application = defaultApplication
+	}
+
+	for _, override := range settingOverrides {
+		config.Application.override(override, &errs)
+	}
+	config.Application.validate("application", &errs)
+
+	config, err := config.compile()
+	if compileErrs, ok := err.(configErrors); ok {
+		errs = append(errs, compileErrs...)
+	}
+	if len(errs) > 0 {
+		return Config{}, errs
+	}
+	return config, nil
+}
+
+// Validates the config and compiles all of its regexes, so that requests do
+// not need to compile them again. All problems are returned as configErrors.
+func (c Config) compile() (Config, error) {
+	var errs configErrors
+
+	checkSecretSets(c.SecretSets, &errs)
+	c.secretRules = compileSecretRules(c, &errs)
+
+	c.admissionRules = nil
+	for _, namespaceRegex := range sortedAdmissionKeys(c.ImageAdmissionRules) {
+		path := fmt.Sprintf("imageAdmissionRules[%q]", namespaceRegex)
+		rule := admissionRule{namespace: errs.regexp(path, namespaceRegex)}
+		for i, image := range c.ImageAdmissionRules[namespaceRegex] {
+			rule.images = append(rule.images, image.compile(fmt.Sprintf("%s[%d]", path, i), &errs))
+		}
+		c.admissionRules = append(c.admissionRules, rule)
+	}
+
+	if c.ExcludedNamespaces != nil {
+		exclusions := make([]NamespaceExclusion, len(c.ExcludedNamespaces))
+		for i, exclusion := range c.ExcludedNamespaces {
+			exclusions[i] = exclusion.compile(fmt.Sprintf("excludedNamespaces[%d]", i), &errs)
+		}
+		c.ExcludedNamespaces = exclusions
+	}
+
+	if c.UserSecretPolicies != nil {
+		policies := make([]UserSecretPolicy, len(c.UserSecretPolicies))
+		for i, policy := range c.UserSecretPolicies {
+			policies[i] = policy.compile(fmt.Sprintf("userSecretPolicies[%d]", i), &errs)
+		}
+		c.UserSecretPolicies = policies
+	}
+
+	c.PreserveOverride.validate("preserveImagePullSecrets", &errs)
+	c.ReportOnly = c.ReportOnly.compile("reportOnly", &errs)
+
+	if c.Application.SelfManagedCerts {
+		name, namespace, err := parseCertService(c.Application.CertService)
+		if err != nil {
+			errs.add("application.certService", "%v", err)
+		}
+		c.certService, c.certNamespace = name, namespace
+	}
+
+	c.logLevel = levelInfo
+	if c.Application.LogLevel != "" {
+		level, err := parseLogLevel(c.Application.LogLevel)
+		if err != nil {
+			errs.add("application.logLevel", "%v", err)
+		}
+		c.logLevel = level
+	}
+
+	if len(errs) > 0 {
+		return Config{}, errs
+	}
+	return c, nil
+}
+
+func sortedRuleKeys(m map[string]map[string]secretList) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedSecretKeys(m map[string]secretList) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedAdmissionKeys(m map[string][]ImageMatcher) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configStore holds the active config. Handlers load the config once per
+// request, so a reload never changes the rules in the middle of a request.
+// It also remembers whether the latest version of the config file was rejected.
+type configStore struct {
+	config    atomic.Value
+	reloadErr atomic.Value
+}
+
+// reloadStatus wraps the error of the last reload, as atomic.Value cannot store nil.
+type reloadStatus struct {
+	err error
+}
+
+func newConfigStore(config Config) *configStore {
+	store := &configStore{}
+	store.Store(config)
+	return store
+}
+
+func (s *configStore) Load() Config {
+	return s.config.Load().(Config)
+}
+
+func (s *configStore) Store(config Config) {
+	s.config.Store(config)
+}
+
+// Loaded reports whether a valid config has been stored.
+func (s *configStore) Loaded() bool {
+	return s.config.Load() != nil
+}
+
+func (s *configStore) SetReloadError(err error) {
+	s.reloadErr.Store(reloadStatus{err: err})
+}
+
+// ReloadError returns why the last reload failed, or nil if it succeeded.
+func (s *configStore) ReloadError() error {
+	status, _ := s.reloadErr.Load().(reloadStatus)
+	return status.err
+}
+
+// configWatcher polls the config file and stores every valid new version in
+// the configStore. The file content is compared rather than its modification
+// time, as kubelet updates mounted ConfigMaps by swapping a symlink.
+type configWatcher struct {
+	path    string
+	configs *configStore
+
+	// checksum of the content that was last loaded, successfully or not, and nil after the file could not be read
+	checksum []byte
+	// error of the last read of the file, empty if it could be read
+	readErr string
+}
+
+// newConfigWatcher starts from the checksum returned by loadConfigFile for the
+// active config, so that changes after it was loaded are picked up.
+func newConfigWatcher(path string, configs *configStore, checksum []byte) *configWatcher {
+	return &configWatcher{path: path, configs: configs, checksum: checksum}
+}
+
+// Checks the config file every interval until stop is closed.
+func (w *configWatcher) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Loads the config file if its content changed. An invalid file is logged
+// and otherwise ignored, the last good config stays active.
+func (w *configWatcher) reload() {
+	config, checksum, err := loadConfigFile(w.path)
+	if checksum == nil {
+		// Like changed content, a read error is only logged and counted when it first appears or changes
+		if err.Error() != w.readErr {
+			w.readErr = err.Error()
+			logger.Errorf("Config reload failed, keeping the active config: %v", err)
+			observeConfigReload(err)
+		}
+		w.configs.SetReloadError(err)
+		// The file is loaded again once it can be read, even if its content did not change, to clear the error
+		w.checksum = nil
+		return
+	}
+	w.readErr = ""
+	if bytes.Equal(checksum, w.checksum) {
+		return
+	}
+	w.checksum = checksum
+
+	observeConfigReload(err)
+	w.configs.SetReloadError(err)
+	if err != nil {
+		logger.Errorf("Config reload of %s failed, keeping the last good config: %v", w.path, err)
+		return
+	}
+
+	w.configs.Store(config)
+	logger.setLevel(config.logLevel)
+	logger.Infof("Config reloaded from %s", w.path)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	validConfigYAML = `
+imagePullSecretRules:
+  ".*":
+    ".*": "testSecret"
+`
+	updatedConfigYAML = `
+imagePullSecretRules:
+  ".*":
+    ".*": "updatedSecret"
+`
+	invalidConfigYAML = `
+imagePullSecretRules:
+  ".*":
+    "(": "brokenSecret"
+`
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := parseConfig([]byte(validConfigYAML))
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if config.ImagePullSecretRules[".*"][".*"][0] != "testSecret" {
+		t.Errorf("Result: Wanted testSecret rule, got %v", config.ImagePullSecretRules)
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	configs := map[string]string{
+		"yaml":            "imagePullSecretRules: [",
+		"unknown field":   "imagePullSecretsRules: {}\n",
+		"secret rule":     invalidConfigYAML,
+		"empty secret":    "imagePullSecretRules:\n  \".*\":\n    \".*\": \"\"\n",
+		"admission rule":  "imageAdmissionRules:\n  \"(\": []\n",
+		"exclusion mode":  "excludedNamespaces:\n- name: testns\n  mode: sometimes\n",
+		"exclusion regex": "excludedNamespaces:\n- regex: \"(\"\n",
+		"service account": "preserveImagePullSecrets:\n  serviceAccounts: [\"deployer\"]\n",
+		"strict reload":   "application:\n  strictReload: sometimes\n",
+		"log level":       "application:\n  logLevel: verbose\n",
+		"report only":     "reportOnly:\n  namespaces: [\"(\"]\n",
+		"capture redact":  "application:\n  captureRedactEnv: maybe\n",
+		"cert service":    "application:\n  selfManagedCerts: true\n  certService: webhook-server\n",
+		"reload interval": "application:\n  configReloadInterval: 0s\n",
+		"listen address":  "application:\n  listenAddr: \"\"\n",
+		"sa secrets":      "application:\n  serviceAccountSecrets: warn\n",
+	}
+
+	for name, content := range configs {
+		content := content
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseConfig([]byte(content)); err == nil {
+				t.Errorf("Error: Wanted error for invalid config, got nil")
+			}
+		})
+	}
+}
+
+// All problems of a config are reported at once, each with its path
+func TestParseConfigReportsAllErrors(t *testing.T) {
+	const content = `
+imagePullSecretRules:
+  "(":
+    "^gcr.io/": "gcr-secret"
+    "[": "other-secret"
+imageAdmissionRules:
+  ".*": ["^gcr.io/", "*"]
+excludedNamespaces:
+- name: kube-system
+- regex: "^cert-manager$"
+  mode: ignore
+unknownSetting: true
+`
+	want := []string{
+		`unknownSetting: unknown field`,
+		`imagePullSecretRules["("]: invalid regex`,
+		`imagePullSecretRules["("]["["]: invalid regex`,
+		`imageAdmissionRules[".*"][1]: invalid regex`,
+		`excludedNamespaces[1].mode: invalid mode "ignore"`,
+	}
+
+	_, err := parseConfig([]byte(content))
+	errs, ok := err.(configErrors)
+	if !ok {
+		t.Fatalf("Error: Wanted configErrors, got %v", err)
+	}
+	if len(errs) != len(want) {
+		t.Errorf("Error: Wanted %d errors, got %d: %v", len(want), len(errs), err)
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("Error: Wanted error containing '%s', got %v", w, err)
+		}
+	}
+}
+
+// Writes the content as a new timestamped directory and swaps the ..data
+// symlink to it, the same way kubelet updates a mounted ConfigMap.
+func swapConfigMap(t *testing.T, dir string, version string, content string) {
+	versionDir := filepath.Join(dir, "..version-"+version)
+	if err := os.Mkdir(versionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(versionDir, "config.yaml"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpLink := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(filepath.Base(versionDir), tmpLink); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigWatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipsa-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	swapConfigMap(t, dir, "1", validConfigYAML)
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	config, checksum, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	configs := newConfigStore(config)
+	watcher := newConfigWatcher(path, configs, checksum)
+
+	activeSecret := func() string {
+		return configs.Load().ImagePullSecretRules[".*"][".*"][0]
+	}
+
+	watcher.reload()
+	if secret := activeSecret(); secret != "testSecret" {
+		t.Errorf("Unchanged file: Wanted testSecret, got %v", secret)
+	}
+
+	swapConfigMap(t, dir, "2", updatedConfigYAML)
+	watcher.reload()
+	if secret := activeSecret(); secret != "updatedSecret" {
+		t.Errorf("Swapped file: Wanted updatedSecret, got %v", secret)
+	}
+	if err := configs.ReloadError(); err != nil {
+		t.Errorf("Swapped file: Wanted nil reload error, got %v", err)
+	}
+
+	swapConfigMap(t, dir, "3", invalidConfigYAML)
+	watcher.reload()
+	if secret := activeSecret(); secret != "updatedSecret" {
+		t.Errorf("Invalid file: Wanted last good config with updatedSecret, got %v", secret)
+	}
+	if configs.ReloadError() == nil {
+		t.Errorf("Invalid file: Wanted reload error, got nil")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	watcher.reload()
+	if secret := activeSecret(); secret != "updatedSecret" {
+		t.Errorf("Missing file: Wanted last good config with updatedSecret, got %v", secret)
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	_, _, err := loadConfigFile(filepath.Join(os.TempDir(), "does-not-exist", "config.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("Error: Wanted missing file error, got %v", err)
+	}
+}
+
+// A file that briefly cannot be read is loaded again when it is back, even with the same content. The read error is
+// only counted once, not on every check.
+func TestConfigWatcherReadRecovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipsa-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(validConfigYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, checksum, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	configs := newConfigStore(config)
+	watcher := newConfigWatcher(path, configs, checksum)
+
+	moved := filepath.Join(dir, "config.yaml.moved")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	failuresBefore := counterValue(configReloads, reloadFailure)
+	watcher.reload()
+	watcher.reload()
+	if configs.ReloadError() == nil {
+		t.Errorf("Missing file: Wanted reload error, got nil")
+	}
+	if diff := counterValue(configReloads, reloadFailure) - failuresBefore; diff != 1 {
+		t.Errorf("Missing file: Wanted 1 failed reload, got %v", diff)
+	}
+
+	if err := os.Rename(moved, path); err != nil {
+		t.Fatal(err)
+	}
+	watcher.reload()
+	if err := configs.ReloadError(); err != nil {
+		t.Errorf("Restored file: Wanted nil reload error, got %v", err)
+	}
+}
+
+// A change between loading the config and starting the watcher is picked up by the first check
+func TestConfigWatcherChangeAfterLoad(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(validConfigYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, checksum, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(updatedConfigYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := newConfigStore(config)
+	newConfigWatcher(path, configs, checksum).reload()
+	if secret := configs.Load().ImagePullSecretRules[".*"][".*"][0]; secret != "updatedSecret" {
+		t.Errorf("Result: Wanted updatedSecret, got %v", secret)
+	}
+}
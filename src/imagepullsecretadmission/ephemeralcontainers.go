@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+const (
+	// Subresource through which ephemeral (debug) containers are added to a running pod
+	ephemeralContainersSubResource = `ephemeralcontainers`
+)
+
+// decodedPod is a Pod together with its ephemeral containers, or the pod
+// template of a workload. The vendored core/v1 API predates ephemeral
+// containers, so they are decoded separately. Only the fields that ephemeral
+// containers share with containers are used.
+// SpecPath is the JSON pointer to the pod spec within the admitted object.
+type decodedPod struct {
+	corev1.Pod
+	EphemeralContainers []corev1.Container
+	SpecPath            string
+}
+
+// Parses the Pod object of an admission request, including spec.ephemeralContainers.
+func decodePod(raw []byte) (decodedPod, error) {
+	pod := decodedPod{SpecPath: podSpecPath}
+	if _, _, err := universalDeserializer.Decode(raw, nil, &pod.Pod); err != nil {
+		return decodedPod{}, fmt.Errorf("could not deserialize pod object: %v", err)
+	}
+
+	var ephemeral struct {
+		Spec struct {
+			EphemeralContainers []corev1.Container `json:"ephemeralContainers"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(raw, &ephemeral); err != nil {
+		return decodedPod{}, fmt.Errorf("could not deserialize ephemeral containers: %v", err)
+	}
+	pod.EphemeralContainers = ephemeral.Spec.EphemeralContainers
+
+	return pod, nil
+}
+
+// Returns the unique, sorted images of the ephemeral containers that are
+// added by an update of the ephemeralcontainers subresource. Ephemeral
+// containers cannot be changed or removed, so new containers are identified
+// by their name.
+func newEphemeralImages(req *admissionRequest, pod decodedPod) ([]string, error) {
+	existing := map[string]struct{}{}
+	if len(req.OldObject.Raw) > 0 {
+		oldPod, err := decodePod(req.OldObject.Raw)
+		if err != nil {
+			return nil, err
+		}
+		for _, container := range oldPod.EphemeralContainers {
+			existing[container.Name] = struct{}{}
+		}
+	}
+
+	var added []corev1.Container
+	for _, container := range pod.EphemeralContainers {
+		if _, ok := existing[container.Name]; !ok {
+			added = append(added, container)
+		}
+	}
+
+	return getUniquePodImages(decodedPod{EphemeralContainers: added}), nil
+}
+
+// The imagePullSecrets of a running pod cannot be changed, neither through
+// the ephemeralcontainers subresource nor otherwise. Instead of patching,
+// the secrets the new ephemeral containers would get from the rules are
+// compared with the secrets of the pod, and the update is rejected if any
+// of them is missing, as the images could not be pulled with the managed
+// credentials.
+func checkEphemeralContainerSecrets(req *admissionRequest, config Config, pod decodedPod) error {
+	images, err := newEphemeralImages(req, pod)
+	if err != nil {
+		return err
+	}
+
+	required, _ := evaluateSecretRules(config.secretRules, req.Namespace, images)
+
+	present := map[string]struct{}{}
+	for _, secret := range pod.Spec.ImagePullSecrets {
+		present[secret.Name] = struct{}{}
+	}
+
+	var missing []string
+	for _, secret := range required {
+		if _, ok := present[secret]; !ok {
+			missing = append(missing, secret)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("ephemeral container images %s need the image pull secrets %s, which pod %s does not have; "+
+		"use an image that is covered by the secrets of the pod",
+		strings.Join(images, ", "), strings.Join(missing, ", "), podName(pod.Pod))
+}
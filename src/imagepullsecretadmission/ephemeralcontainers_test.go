@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"strings"
+	"testing"
+)
+
+// Builds the JSON of a running pod in testns with an app container, the given
+// image pull secrets and an ephemeral container for each of the given images.
+func ephemeralPodJSON(t *testing.T, secrets []string, ephemeralImages ...string) []byte {
+	type named struct {
+		Name  string `json:"name,omitempty"`
+		Image string `json:"image,omitempty"`
+	}
+
+	var pullSecrets, ephemeral []named
+	for _, secret := range secrets {
+		pullSecrets = append(pullSecrets, named{Name: secret})
+	}
+	for i, image := range ephemeralImages {
+		ephemeral = append(ephemeral, named{Name: fmt.Sprintf("debugger-%d", i), Image: image})
+	}
+
+	pod := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "app-1", "namespace": "testns"},
+		"spec": map[string]interface{}{
+			"containers":          []named{{Name: "app", Image: "gcr.io/team/app"}},
+			"imagePullSecrets":    pullSecrets,
+			"ephemeralContainers": ephemeral,
+		},
+	}
+
+	jsonbytes, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("Failed JSON marshal with %v", err)
+	}
+	return jsonbytes
+}
+
+// Builds an update of the ephemeralcontainers subresource from the old to the new pod.
+func ephemeralRequest(oldPod []byte, newPod []byte) *admissionRequest {
+	return &admissionRequest{
+		UID:         "test-uid",
+		Namespace:   "testns",
+		Resource:    podResource,
+		SubResource: ephemeralContainersSubResource,
+		Operation:   v1beta1.Update,
+		Object:      runtime.RawExtension{Raw: newPod},
+		OldObject:   runtime.RawExtension{Raw: oldPod},
+	}
+}
+
+func TestGetUniquePodImagesEphemeral(t *testing.T) {
+	pod, err := decodePod(ephemeralPodJSON(t, nil, "busybox", "gcr.io/team/app"))
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+
+	images := getUniquePodImages(pod)
+	if strings.Join(images, ",") != "busybox,gcr.io/team/app" {
+		t.Errorf("Result: Wanted ephemeral images included, got %v", images)
+	}
+}
+
+func TestEphemeralContainerSecrets(t *testing.T) {
+	config := mustCompile(Config{
+		ImagePullSecretRules: map[string]map[string]secretList{
+			".*": {"^gcr.io/": {"gcr-secret"}, "^quay.io/": {"quay-secret"}},
+		},
+	})
+
+	t.Run("covered by pod secrets", func(t *testing.T) {
+		oldPod := ephemeralPodJSON(t, []string{"gcr-secret"})
+		newPod := ephemeralPodJSON(t, []string{"gcr-secret"}, "gcr.io/team/debug")
+
+		res, err := manageImagePullSecrets(ephemeralRequest(oldPod, newPod), config)
+		if err != nil || res.patches != nil {
+			t.Errorf("Wanted nil result and error, got %v, %v", res.patches, err)
+		}
+	})
+
+	t.Run("missing secret", func(t *testing.T) {
+		const want = "ephemeral container images quay.io/team/debug need the image pull secrets quay-secret, which pod app-1 does not have"
+		oldPod := ephemeralPodJSON(t, []string{"gcr-secret"}, "gcr.io/team/debug")
+		newPod := ephemeralPodJSON(t, []string{"gcr-secret"}, "gcr.io/team/debug", "quay.io/team/debug")
+
+		_, err := manageImagePullSecrets(ephemeralRequest(oldPod, newPod), config)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Error: Wanted '%v', got %v", want, err)
+		}
+	})
+
+	t.Run("excluded namespace", func(t *testing.T) {
+		excluded := config
+		excluded.ExcludedNamespaces = []NamespaceExclusion{{Name: "testns"}}
+		excluded = mustCompile(excluded)
+
+		newPod := ephemeralPodJSON(t, nil, "quay.io/team/debug")
+		res, err := manageImagePullSecrets(ephemeralRequest(ephemeralPodJSON(t, nil), newPod), excluded)
+		if err != nil || res.patches != nil {
+			t.Errorf("Wanted nil result and error, got %v, %v", res.patches, err)
+		}
+	})
+}
+
+func TestEphemeralContainerImageAdmission(t *testing.T) {
+	config := mustCompile(Config{
+		ImageAdmissionRules: map[string][]ImageMatcher{
+			"^testns$": {{Registry: "gcr.io"}},
+		},
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		newPod := ephemeralPodJSON(t, nil, "gcr.io/team/debug")
+		if _, err := admitPodImages(ephemeralRequest(ephemeralPodJSON(t, nil), newPod), config); err != nil {
+			t.Errorf("Error: Wanted nil, got %v", err)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		const want = "images not allowed in namespace testns: busybox (allowed registries: registry=gcr.io)"
+		newPod := ephemeralPodJSON(t, nil, "busybox")
+
+		_, err := admitPodImages(ephemeralRequest(ephemeralPodJSON(t, nil), newPod), config)
+		if err == nil || err.Error() != want {
+			t.Errorf("Error: Wanted '%v', got %v", want, err)
+		}
+	})
+
+	t.Run("pod creation", func(t *testing.T) {
+		request := &admissionRequest{
+			UID:       "test-uid",
+			Namespace: "testns",
+			Resource:  podResource,
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: ephemeralPodJSON(t, nil, "busybox")},
+		}
+
+		_, err := admitPodImages(request, config)
+		if err == nil || !strings.Contains(err.Error(), "busybox") {
+			t.Errorf("Error: Wanted rejection of the ephemeral busybox image, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"regexp"
+)
+
+const (
+	// The admission controllers ignore pods in the namespace completely.
+	exclusionBypass = `bypass`
+	// Managed secrets are added, but the secrets the user put on the pod are kept.
+	exclusionKeepUserSecrets = `keepUserSecrets`
+)
+
+// NamespaceExclusion excludes namespaces from the admission controllers, either
+// by their literal Name or by a Regex. Mode is one of exclusionBypass (default)
+// or exclusionKeepUserSecrets.
+type NamespaceExclusion struct {
+	Name  string `yaml:"name,omitempty"`
+	Regex string `yaml:"regex,omitempty"`
+	Mode  string `yaml:"mode,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// Namespaces that are excluded if the config does not list excludedNamespaces.
+var defaultExcludedNamespaces = []NamespaceExclusion{
+	{Name: metav1.NamespaceSystem},
+	{Name: metav1.NamespacePublic},
+	{Name: "istio-system"},
+}
+
+// Returns the exclusion mode of the first exclusion matching the namespace, or
+// an empty string if the namespace is not excluded.
+// The built-in defaults only apply if the config does not set excludedNamespaces,
+// an empty list excludes nothing.
+func namespaceExclusionMode(config Config, namespace string) string {
+	exclusions := config.ExcludedNamespaces
+	if exclusions == nil {
+		exclusions = defaultExcludedNamespaces
+	}
+
+	for _, exclusion := range exclusions {
+		if !exclusion.matches(namespace) {
+			continue
+		}
+		if exclusion.Mode == "" {
+			return exclusionBypass
+		}
+		return exclusion.Mode
+	}
+
+	return ""
+}
+
+// Matches the namespace against the literal name or the regex of the exclusion.
+func (e NamespaceExclusion) matches(namespace string) bool {
+	if e.Name != "" && e.Name == namespace {
+		return true
+	}
+	return e.regex != nil && e.regex.MatchString(namespace)
+}
+
+// Checks the mode and compiles the regex of the exclusion.
+func (e NamespaceExclusion) compile(path string, errs *configErrors) NamespaceExclusion {
+	switch e.Mode {
+	case "", exclusionBypass, exclusionKeepUserSecrets:
+	default:
+		errs.add(path+".mode", "invalid mode %q, must be %s or %s", e.Mode, exclusionBypass, exclusionKeepUserSecrets)
+	}
+
+	if e.Name == "" && e.Regex == "" {
+		errs.add(path, "either name or regex must be set")
+	}
+	if e.Regex != "" {
+		e.regex = errs.regexp(path+".regex", e.Regex)
+	}
+	return e
+}
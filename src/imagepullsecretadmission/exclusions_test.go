@@ -0,0 +1,115 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+// Builds an AdmissionRequest for a pod in the given namespace with a single
+// container and the given user-provided image pull secrets.
+func podWithSecretsRequest(t *testing.T, namespace string, secrets ...string) *admissionRequest {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Image: "test"}},
+		},
+	}
+	for _, secret := range secrets {
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: secret})
+	}
+	return podRequest(t, pod)
+}
+
+func TestNamespaceExclusionMode(t *testing.T) {
+	configured := mustCompile(Config{
+		ExcludedNamespaces: []NamespaceExclusion{
+			{Name: "kube-system"},
+			{Regex: "^cert-manager$", Mode: exclusionBypass},
+			{Regex: "^monitoring-.*", Mode: exclusionKeepUserSecrets},
+		},
+	})
+
+	tests := []struct {
+		config    Config
+		namespace string
+		want      string
+	}{
+		{defaultConfig, "kube-system", exclusionBypass},
+		{defaultConfig, "kube-public", exclusionBypass},
+		{defaultConfig, "istio-system", exclusionBypass},
+		{defaultConfig, "cert-manager", ""},
+		{configured, "kube-system", exclusionBypass},
+		{configured, "istio-system", ""},
+		{configured, "cert-manager", exclusionBypass},
+		{configured, "cert-manager-webhook", ""},
+		{configured, "monitoring-prod", exclusionKeepUserSecrets},
+		{Config{ExcludedNamespaces: []NamespaceExclusion{}}, "kube-system", ""},
+	}
+
+	for _, test := range tests {
+		mode := namespaceExclusionMode(test.config, test.namespace)
+		if mode != test.want {
+			t.Errorf("%s: Mode: Wanted '%v', got '%v'", test.namespace, test.want, mode)
+		}
+	}
+}
+
+func TestNamespaceExclusionInvalid(t *testing.T) {
+	tests := map[string]struct {
+		exclusion NamespaceExclusion
+		want      string
+	}{
+		"invalid mode":  {NamespaceExclusion{Name: "testns", Mode: "sometimes"}, "excludedNamespaces[0].mode: invalid mode"},
+		"invalid regex": {NamespaceExclusion{Regex: "("}, "excludedNamespaces[0].regex: invalid regex"},
+		"empty":         {NamespaceExclusion{Mode: exclusionBypass}, "excludedNamespaces[0]: either name or regex must be set"},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			_, err := Config{ExcludedNamespaces: []NamespaceExclusion{test.exclusion}}.compile()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Error: Wanted '%v', got %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestKeepUserSecretsAdmission(t *testing.T) {
+	config := defaultConfig
+	config.ExcludedNamespaces = []NamespaceExclusion{{Name: "testns", Mode: exclusionKeepUserSecrets}}
+	config = mustCompile(config)
+
+	t.Run("user secrets", func(t *testing.T) {
+		res, err := manageImagePullSecrets(podWithSecretsRequest(t, "testns", "my-creds"), config)
+		if err != nil {
+			t.Errorf("Error: Wanted nil, got %v", err)
+		}
+		if len(res.patches) != 1 || res.patches[0].Op != "add" || res.patches[0].Path != "/spec/imagePullSecrets/-" ||
+			patchValue(t, res.patches[0]) != `{"name":"testSecret"}` {
+			t.Errorf("Result: Wanted only testSecret to be appended, got %v", res.patches)
+		}
+	})
+
+	t.Run("managed secret already present", func(t *testing.T) {
+		res, err := manageImagePullSecrets(podWithSecretsRequest(t, "testns", "testSecret"), config)
+		if err != nil {
+			t.Errorf("Error: Wanted nil, got %v", err)
+		}
+		if res.patches != nil {
+			t.Errorf("Result: Wanted nil, got %v", res.patches)
+		}
+	})
+
+	t.Run("no user secrets", func(t *testing.T) {
+		res, err := manageImagePullSecrets(podWithSecretsRequest(t, "testns"), config)
+		if err != nil {
+			t.Errorf("Error: Wanted nil, got %v", err)
+		}
+		if len(res.patches) != 1 || res.patches[0].Path != "/spec/imagePullSecrets" {
+			t.Errorf("Result: Wanted a fresh imagePullSecrets array, got %v", res.patches)
+		}
+	})
+}
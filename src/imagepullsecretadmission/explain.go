@@ -0,0 +1,230 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"strings"
+	"text/tabwriter"
+)
+
+// The resources of the kinds that can be explained, keyed by apiVersion and kind.
+var kindResources = map[string]metav1.GroupVersionResource{
+	"v1/Pod":                podResource,
+	"apps/v1/Deployment":    deploymentResource,
+	"apps/v1/StatefulSet":   statefulSetResource,
+	"apps/v1/DaemonSet":     daemonSetResource,
+	"batch/v1/Job":          jobResource,
+	"batch/v1/CronJob":      cronJobResource,
+	"batch/v1beta1/CronJob": cronJobV1beta1Resource,
+}
+
+// runExplain evaluates a Pod or workload manifest against a config file offline and prints every step of the
+// decision: the normalised images, every rule that was checked, the JSON patch and the resulting imagePullSecrets.
+// The manifest is read from the file given as argument, or from stdin if there is none or it is "-".
+func runExplain(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "config file to evaluate the manifest against")
+	namespace := flags.String("namespace", "", "namespace of the object, defaults to the namespace of the manifest")
+	user := flags.String("user", "", "requesting user, for the preserve annotation")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: explain [flags] [manifest.yaml|-]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return errors.New("explain takes at most one manifest")
+	}
+
+	config, _, err := loadConfigFile(*configPath)
+	if err != nil {
+		return fmt.Errorf("cannot load config file %s: %v", *configPath, err)
+	}
+
+	var manifest []byte
+	if path := flags.Arg(0); path != "" && path != "-" {
+		manifest, err = ioutil.ReadFile(path)
+	} else {
+		manifest, err = ioutil.ReadAll(stdin)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read manifest: %v", err)
+	}
+
+	req, err := explainRequest(manifest, *namespace, *user)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := explain(&out, req, config); err != nil {
+		return err
+	}
+	_, err = stdout.Write(out.Bytes())
+	return err
+}
+
+// Builds the AdmissionRequest the API server would send for creating the object of the manifest.
+func explainRequest(manifest []byte, namespace string, user string) (*admissionRequest, error) {
+	raw, err := utilyaml.ToJSON(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse manifest: %v", err)
+	}
+
+	var object struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest: %v", err)
+	}
+
+	resource, ok := kindResources[object.APIVersion+"/"+object.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %s %s, must be a Pod or a workload", object.APIVersion, object.Kind)
+	}
+
+	if namespace == "" {
+		namespace = object.Namespace
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	gv := object.GroupVersionKind()
+	return &admissionRequest{
+		UID:       "explain",
+		Kind:      metav1.GroupVersionKind{Group: gv.Group, Version: gv.Version, Kind: gv.Kind},
+		Resource:  resource,
+		Name:      object.Name,
+		Namespace: namespace,
+		Operation: v1beta1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: user},
+		Object:    runtime.RawExtension{Raw: raw},
+	}, nil
+}
+
+// Writes the explanation of the decision of the mutating webhook on the request.
+func explain(out io.Writer, req *admissionRequest, config Config) error {
+	pod, err := decodeAdmissionObject(req)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Object: %s %s in namespace %s, pod spec at %s\n",
+		req.Kind.Kind, podName(pod.Pod), req.Namespace, pod.SpecPath)
+	if config.ReportOnly.applies(req.Namespace) {
+		fmt.Fprintln(out, "Report-only: the webhook admits the object unchanged and only reports this decision")
+	}
+
+	images := getUniquePodImages(pod)
+	fmt.Fprintln(out, "\nImages:")
+	for _, image := range images {
+		parsed := newPodImage(image)
+		if parsed.parsed {
+			fmt.Fprintf(out, "  %s => %s\n", image, parsed.ref)
+		} else {
+			fmt.Fprintf(out, "  %s => cannot be parsed, only regex matchers apply\n", image)
+		}
+	}
+
+	switch namespaceExclusionMode(config, req.Namespace) {
+	case exclusionBypass:
+		fmt.Fprintf(out, "\nNamespace %s is excluded, the webhook does not change the object\n", req.Namespace)
+		return nil
+	case exclusionKeepUserSecrets:
+		fmt.Fprintf(out, "\nNamespace %s keeps user secrets, managed secrets are added to them\n", req.Namespace)
+	default:
+		switch policy := userSecretPolicy(config, req.Namespace); policy.Policy {
+		case userSecretsMerge:
+			fmt.Fprintf(out, "\nNamespace %s keeps user secrets, managed secrets are added to them\n", req.Namespace)
+		case userSecretsFilter:
+			fmt.Fprintf(out, "\nNamespace %s keeps user secrets matching %s, managed secrets are added to them\n",
+				req.Namespace, strings.Join(policy.Keep, ", "))
+		}
+	}
+
+	fmt.Fprintln(out, "\nRules:")
+	rules := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	lastImage := ""
+	traceSecretRules(config.secretRules, req.Namespace, images, func(check ruleCheck) {
+		if check.image.raw != lastImage {
+			lastImage = check.image.raw
+			fmt.Fprintf(rules, "  %s\n", lastImage)
+		}
+		fmt.Fprintf(rules, "    %s\t%s\n", check.rule.id, describeRuleCheck(check))
+	})
+	rules.Flush()
+
+	result, err := manageImagePullSecrets(req, config)
+	if err != nil {
+		fmt.Fprintf(out, "\nDenied: %v\n", err)
+		return nil
+	}
+
+	fmt.Fprintln(out, "\nPatch:")
+	if len(result.patches) == 0 {
+		fmt.Fprintln(out, "  none")
+	} else {
+		patch, err := json.MarshalIndent(result.patches, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "  %s\n", patch)
+	}
+
+	patched, err := applyPatch(req.Object.Raw, result.patches)
+	if err != nil {
+		return fmt.Errorf("cannot apply patch: %v", err)
+	}
+	patchedReq := *req
+	patchedReq.Object = runtime.RawExtension{Raw: patched}
+	patchedPod, err := decodeAdmissionObject(&patchedReq)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "\nimagePullSecrets:")
+	if len(patchedPod.Spec.ImagePullSecrets) == 0 {
+		fmt.Fprintln(out, "  none")
+	}
+	for _, secret := range patchedPod.Spec.ImagePullSecrets {
+		fmt.Fprintf(out, "  - %s\n", secret.Name)
+	}
+	return nil
+}
+
+// Describes why a rule did or did not match an image.
+func describeRuleCheck(check ruleCheck) string {
+	switch {
+	case !check.namespaceMatched:
+		return "no match: namespace"
+	case !check.imageMatched:
+		return "no match: image"
+	}
+
+	description := "match: " + strings.Join(check.rule.secrets, ", ")
+	if check.rule.firstMatch {
+		description += " (firstMatch, remaining rules skipped)"
+	}
+	return description
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const explainConfigYAML = `
+rules:
+- name: team-a
+  namespaces: ["^team-a$"]
+  images: ["^gcr.io/team-a/"]
+  secrets: ["team-a-gcr"]
+  evaluation: firstMatch
+- namespaces: [".*"]
+  images: [{registry: gcr.io}]
+  secrets: ["gcr"]
+`
+
+const explainDeploymentYAML = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: team-a
+spec:
+  template:
+    spec:
+      imagePullSecrets: [{name: my-creds}]
+      containers:
+      - name: app
+        image: gcr.io/team-a/app:v1
+      - name: proxy
+        image: nginx
+`
+
+// Runs explain with the config and the manifest on stdin, and returns its output.
+func runExplainTest(t *testing.T, manifest string, args ...string) (string, error) {
+	dir, err := ioutil.TempDir("", "ipsa-explain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(configPath, []byte(explainConfigYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = runExplain(append([]string{"-config", configPath}, args...), strings.NewReader(manifest), &out)
+	return out.String(), err
+}
+
+func TestExplain(t *testing.T) {
+	out, err := runExplainTest(t, explainDeploymentYAML)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+
+	want := []string{
+		"Deployment app in namespace team-a, pod spec at /spec/template/spec",
+		"nginx => docker.io/library/nginx:latest",
+		"team-a  match: team-a-gcr (firstMatch, remaining rules skipped)",
+		"rules[1]  no match: image",
+		`"path": "/spec/template/spec/imagePullSecrets"`,
+		"imagePullSecrets:\n  - team-a-gcr\n",
+	}
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("Result: Wanted output containing %q, got\n%s", w, out)
+		}
+	}
+}
+
+func TestExplainNamespace(t *testing.T) {
+	out, err := runExplainTest(t, explainDeploymentYAML, "-namespace", "team-b", "-")
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	for _, w := range []string{"no match: namespace", "rules[1]  match: gcr", "imagePullSecrets:\n  - gcr\n"} {
+		if !strings.Contains(out, w) {
+			t.Errorf("Result: Wanted output containing %q, got\n%s", w, out)
+		}
+	}
+
+	out, err = runExplainTest(t, explainDeploymentYAML, "-namespace", "kube-system")
+	if err != nil || !strings.Contains(out, "Namespace kube-system is excluded") {
+		t.Errorf("Result: Wanted excluded namespace, got %v\n%s", err, out)
+	}
+}
+
+func TestExplainInvalidManifest(t *testing.T) {
+	manifests := map[string]string{
+		"unsupported kind": "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n",
+		"invalid yaml":     "apiVersion: [",
+	}
+	for name, manifest := range manifests {
+		manifest := manifest
+		t.Run(name, func(t *testing.T) {
+			if _, err := runExplainTest(t, manifest); err == nil {
+				t.Errorf("Error: Wanted error, got nil")
+			}
+		})
+	}
+}
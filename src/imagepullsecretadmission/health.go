@@ -0,0 +1,64 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// readinessCheck returns why the webhook cannot answer admission requests correctly, or nil if it can.
+type readinessCheck func() error
+
+// configReady checks that a valid config is active and, if the config asks for strict reloads,
+// that the latest version of the config file was loaded.
+func configReady(configs *configStore) readinessCheck {
+	return func() error {
+		if !configs.Loaded() {
+			return errors.New("config is not loaded")
+		}
+		if err := configs.ReloadError(); err != nil && configs.Load().Application.StrictReload {
+			return fmt.Errorf("config reload failed: %v", err)
+		}
+		return nil
+	}
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProbeResponse(w, http.StatusOK, "ok")
+	})
+}
+
+// readyzHandler reports whether all checks pass. Otherwise it answers 503 with the reasons,
+// so the replica does not receive admission requests.
+func readyzHandler(checks ...readinessCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reasons []string
+		for _, check := range checks {
+			if err := check(); err != nil {
+				reasons = append(reasons, err.Error())
+			}
+		}
+
+		if len(reasons) > 0 {
+			writeProbeResponse(w, http.StatusServiceUnavailable, "not ready: "+strings.Join(reasons, "; "))
+			return
+		}
+		writeProbeResponse(w, http.StatusOK, "ok")
+	})
+}
+
+func writeProbeResponse(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(message + "\n")); err != nil {
+		logger.Errorf("Could not write probe response: %v", err)
+	}
+}
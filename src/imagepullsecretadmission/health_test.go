@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate valid for an hour and its key to dir and returns their paths.
+func writeTestKeyPair(t *testing.T, dir string) (string, string) {
+	return writeTestKeyPairValid(t, dir, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// Writes a self-signed certificate valid between notBefore and notAfter and its key to dir and returns their paths.
+func writeTestKeyPairValid(t *testing.T, dir string, notBefore time.Time, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "webhook-server.webhook-demo.svc"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, tlsCertFile)
+	keyPath := filepath.Join(dir, tlsKeyFile)
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func probe(handler http.Handler, path string) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code
+}
+
+func TestHealthz(t *testing.T) {
+	if code := probe(Mux(newConfigStore(defaultConfig)), "/healthz"); code != http.StatusOK {
+		t.Errorf("Status: Wanted %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestReadyzConfig(t *testing.T) {
+	strict := mustCompile(Config{Application: Application{StrictReload: true}})
+	reloadErr := errors.New("test error")
+
+	tests := map[string]struct {
+		configs *configStore
+		config  *Config
+		err     error
+		want    int
+	}{
+		"not loaded":                {configs: &configStore{}, want: http.StatusServiceUnavailable},
+		"loaded":                    {configs: newConfigStore(defaultConfig), want: http.StatusOK},
+		"reload failed":             {configs: newConfigStore(defaultConfig), err: reloadErr, want: http.StatusOK},
+		"strict reload succeeded":   {configs: newConfigStore(strict), want: http.StatusOK},
+		"strict reload failed":      {configs: newConfigStore(strict), err: reloadErr, want: http.StatusServiceUnavailable},
+		"strict reload failed once": {configs: newConfigStore(strict), config: &strict, err: reloadErr, want: http.StatusOK},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			test.configs.SetReloadError(test.err)
+			if test.config != nil {
+				// A later reload succeeded
+				test.configs.Store(*test.config)
+				test.configs.SetReloadError(nil)
+			}
+			if code := probe(Mux(test.configs), "/readyz"); code != test.want {
+				t.Errorf("Status: Wanted %d, got %d", test.want, code)
+			}
+		})
+	}
+}
+
+func TestReadyzTLSKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipsa-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certs := newCertReloader(filepath.Join(dir, tlsCertFile), filepath.Join(dir, tlsKeyFile), 0)
+	mux := Mux(newConfigStore(defaultConfig), certificateReady(certs))
+	if code := probe(mux, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Missing key pair: Wanted %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	writeTestKeyPair(t, dir)
+	if code := probe(mux, "/readyz"); code != http.StatusOK {
+		t.Errorf("Readable key pair: Wanted %d, got %d", http.StatusOK, code)
+	}
+}
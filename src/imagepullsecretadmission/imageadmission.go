@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Reject pods that use images which are not allowed in their namespace.
+// Every image of the pod has to match at least one image regex of a namespace
+// regex in ImageAdmissionRules that matches the pod's namespace. This closes
+// the gap left by manageImagePullSecrets, which can only withhold credentials
+// but cannot stop a pod from pulling public images.
+//
+// If no ImageAdmissionRules are configured, every pod is admitted.
+func admitPodImages(req *admissionRequest, config Config) (admissionResult, error) {
+	// Same as for the mutating webhook, only Pods and workloads are expected here.
+	if !supportedResource(req) {
+		requestLogger(req).Warnf("unsupported resource %s, subresource %q", req.Resource, req.SubResource)
+		return admissionResult{}, nil
+	}
+	if immutableTemplate(req) {
+		return admissionResult{}, nil
+	}
+
+	namespace := req.Namespace
+
+	if config.ImageAdmissionRules == nil {
+		return admissionResult{}, nil
+	}
+
+	// Excluded namespaces that keep user secrets are still subject to image admission
+	if namespaceExclusionMode(config, namespace) == exclusionBypass {
+		return admissionResult{}, nil
+	}
+
+	// Parse the Pod object, or the pod template of a workload.
+	pod, err := decodeAdmissionObject(req)
+	if err != nil {
+		return admissionResult{}, err
+	}
+
+	// Debug containers added to a running pod are checked on their own
+	images := getUniquePodImages(pod)
+	if req.SubResource == ephemeralContainersSubResource {
+		if images, err = newEphemeralImages(req, pod); err != nil {
+			return admissionResult{}, err
+		}
+	}
+
+	allowed := allowedImageMatchers(config.admissionRules, namespace)
+
+	var rejected []string
+	for _, image := range images {
+		if !matchesAnyImage(allowed, newPodImage(image)) {
+			rejected = append(rejected, image)
+		}
+	}
+
+	if len(rejected) == 0 {
+		return admissionResult{}, nil
+	}
+	return admissionResult{}, imagesNotAllowedError(namespace, rejected, allowed)
+}
+
+// Collects the image matchers of all namespace regexes that match the namespace.
+// The result is sorted and free of duplicates so that error messages are stable.
+func allowedImageMatchers(admissionRules []admissionRule, namespace string) []imageMatcher {
+	matcherMap := map[string]imageMatcher{}
+
+	for _, rule := range admissionRules {
+		if rule.namespace.MatchString(namespace) {
+			for _, image := range rule.images {
+				matcherMap[image.source] = image
+			}
+		}
+	}
+
+	var sources []string
+	for source := range matcherMap {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	var matchers []imageMatcher
+	for _, source := range sources {
+		matchers = append(matchers, matcherMap[source])
+	}
+	return matchers
+}
+
+// Builds the rejection message listing every offending image together with the
+// image patterns that would have been allowed in the namespace.
+func imagesNotAllowedError(namespace string, rejected []string, allowed []imageMatcher) error {
+	sort.Strings(rejected)
+
+	var sources []string
+	for _, matcher := range allowed {
+		sources = append(sources, matcher.source)
+	}
+
+	allowedMsg := "no images are allowed in this namespace"
+	if len(sources) > 0 {
+		allowedMsg = fmt.Sprintf("allowed registries: %s", strings.Join(sources, ", "))
+	}
+
+	return fmt.Errorf("images not allowed in namespace %s: %s (%s)",
+		namespace, strings.Join(rejected, ", "), allowedMsg)
+}
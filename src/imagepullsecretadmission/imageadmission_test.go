@@ -0,0 +1,98 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+var imageAdmissionConfig Config = mustCompile(Config{
+	ImageAdmissionRules: map[string][]ImageMatcher{
+		"^team-.*$": {{Regex: "^gcr.io/"}},
+		"^team-a$":  {{Regex: "^quay.io/team-a/"}},
+	},
+})
+
+// Builds an AdmissionRequest for a pod in the given namespace that uses
+// the given images, the first one in an init container.
+func imagePodRequest(t *testing.T, namespace string, images ...string) *admissionRequest {
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace}}
+	for i, image := range images {
+		if i == 0 {
+			pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Image: image})
+		} else {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Image: image})
+		}
+	}
+	return podRequest(t, pod)
+}
+
+func TestImageAdmissionAllowed(t *testing.T) {
+	tests := map[string]*admissionRequest{
+		"team-a gcr":  imagePodRequest(t, "team-a", "gcr.io/init", "gcr.io/app"),
+		"team-a quay": imagePodRequest(t, "team-a", "gcr.io/init", "quay.io/team-a/app"),
+		"team-b gcr":  imagePodRequest(t, "team-b", "gcr.io/app"),
+		"kube-system": imagePodRequest(t, "kube-system", "nginx"),
+	}
+
+	for name, request := range tests {
+		request := request
+		t.Run(name, func(t *testing.T) {
+			res, err := admitPodImages(request, imageAdmissionConfig)
+			if err != nil {
+				t.Errorf("Error: Wanted nil, got %v", err)
+			}
+			if res.patches != nil {
+				t.Errorf("Result: Wanted nil, got %v", res.patches)
+			}
+		})
+	}
+
+	t.Run("no rules", func(t *testing.T) {
+		res, err := admitPodImages(imagePodRequest(t, "other", "nginx"), defaultConfig)
+		if err != nil || res.patches != nil {
+			t.Errorf("Wanted nil result and error without image admission rules, got %v, %v", res.patches, err)
+		}
+	})
+}
+
+func TestImageAdmissionRejected(t *testing.T) {
+	tests := map[string]struct {
+		request *admissionRequest
+		want    string
+	}{
+		"dockerhub in team-a": {
+			request: imagePodRequest(t, "team-a", "nginx", "gcr.io/app", "docker.io/library/redis"),
+			want:    "images not allowed in namespace team-a: docker.io/library/redis, nginx (allowed registries: ^gcr.io/, ^quay.io/team-a/)",
+		},
+		"foreign quay in team-b": {
+			request: imagePodRequest(t, "team-b", "quay.io/team-a/app"),
+			want:    "images not allowed in namespace team-b: quay.io/team-a/app (allowed registries: ^gcr.io/)",
+		},
+		"unmatched namespace": {
+			request: imagePodRequest(t, "other", "gcr.io/app"),
+			want:    "images not allowed in namespace other: gcr.io/app (no images are allowed in this namespace)",
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			_, err := admitPodImages(test.request, imageAdmissionConfig)
+			if err == nil || err.Error() != test.want {
+				t.Errorf("Error: Wanted '%v', got '%v'", test.want, err)
+			}
+		})
+	}
+}
+
+func TestImageAdmissionInvalidRegex(t *testing.T) {
+	const want = `imageAdmissionRules[".*"][1]: invalid regex`
+	config := Config{ImageAdmissionRules: map[string][]ImageMatcher{".*": {{Regex: "^gcr.io/"}, {Regex: "("}}}}
+
+	_, err := config.compile()
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Error: Wanted '%v', got %v", want, err)
+	}
+}
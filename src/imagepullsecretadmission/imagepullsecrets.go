@@ -5,77 +5,132 @@ Licensed under the MIT license. See LICENSE file in the project root for details
 
 package main
 
-
 import (
+	"encoding/json"
 	"fmt"
-	"regexp"
-	"k8s.io/api/admission/v1beta1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	corev1 "k8s.io/api/core/v1"
-	"log"
+	"sort"
+	"strings"
+)
+
+// Keys of the audit annotations describing the changes to the image pull secrets. The API server prefixes them with
+// the name of the webhook.
+const (
+	auditMatchedRules   = "matched-rules"
+	auditRemovedSecrets = "removed-image-pull-secrets"
+	auditAddedSecrets   = "added-image-pull-secrets"
 )
 
 // Remove user-provided image pull secrets and add managed ones based on configuration.
 // This allows also blocking certain registries / paths from specific namespaces.
 //
 // Examples of use-cases can be found in the tests:  TODO O:)
-func manageImagePullSecrets(req *v1beta1.AdmissionRequest, config Config) ([]patchOperation, error) {
-	// This handler should only get called on Pod objects as per the MutatingWebhookConfiguration in the YAML file.
+func manageImagePullSecrets(req *admissionRequest, config Config) (admissionResult, error) {
+	// This handler should only get called on Pods and workloads as per the MutatingWebhookConfiguration in the YAML file.
 	// However, if (for whatever reason) this gets invoked on an object of a different kind, issue a log message but
 	// let the object request pass through otherwise.
-	if req.Resource != podResource {
-		log.Printf("expect resource to be %s", podResource)
-		return nil, nil
+	if !supportedResource(req) {
+		requestLogger(req).Warnf("unsupported resource %s, subresource %q", req.Resource, req.SubResource)
+		return admissionResult{}, nil
+	}
+	if immutableTemplate(req) {
+		return admissionResult{}, nil
+	}
+
+	namespace := req.Namespace
+
+	// Ignore excluded namespaces, unless they only opt out of the removal of user secrets
+	exclusionMode := namespaceExclusionMode(config, namespace)
+	if exclusionMode == exclusionBypass {
+		return admissionResult{}, nil
 	}
 
+	// Parse the Pod object, or the pod template of a workload.
+	pod, err := decodeAdmissionObject(req)
+	if err != nil {
+		return admissionResult{}, err
+	}
 
-	// Parse the Pod object.
-	raw       := req.Object.Raw
-	pod       := corev1.Pod{}
-	if _, _, err := universalDeserializer.Decode(raw, nil, &pod); err != nil {
-		return nil, fmt.Errorf("could not deserialize pod object: %v", err)
+	// Debug containers are added to running pods, whose secrets cannot be patched anymore
+	if req.SubResource == ephemeralContainersSubResource {
+		return admissionResult{}, checkEphemeralContainerSecrets(req, config, pod)
 	}
 
-	var patches []patchOperation
-	namespace := req.Namespace
+	// A permitted requester may ask to keep the user secrets as a break-glass measure
+	preserve, err := preserveUserSecrets(req, config, pod.Pod)
+	if err != nil {
+		return admissionResult{}, err
+	}
+
+	var result admissionResult
+	images := getUniquePodImages(pod)
+	secrets, matchedRules := evaluateSecretRules(config.secretRules, namespace, images)
+	result.matchedRules = matchedRules
 
-	// Ignore system namespaces
-	if namespace == metav1.NamespacePublic || namespace == metav1.NamespaceSystem  || namespace == "istio-system" {
-		return nil, nil
+	// The user secrets kept by the policy of the namespace stay on the pod, followed by the managed secrets they
+	// do not include yet. Excluded namespaces and the break-glass annotation keep all of them.
+	policy := userSecretPolicy(config, namespace)
+	if exclusionMode == exclusionKeepUserSecrets || preserve {
+		policy = UserSecretPolicy{Policy: userSecretsMerge}
 	}
+	existing := secretNames(pod.Spec.ImagePullSecrets)
+	desired := appendMissing(policy.kept(existing), secrets)
 
-	images    := getUniquePodImages(pod)
-	patches    = append(patches, removeExistingPullSecrets(namespace, pod)...)
+	result.patches = patchSecretList(pod.SpecPath, existing, desired)
+	result.removedSecrets = appendMissing(nil, missingSecrets(existing, desired))
+	result.addedSecrets = missingSecrets(desired, existing)
+	explainSecretChanges(&result, secrets)
 
-	if config.ImagePullSecretRules != nil {
-		patches = append(patches, patchPod(config.ImagePullSecretRules, namespace, images)...)
+	// The kubelet also uses the image pull secrets of the ServiceAccount
+	if err := serviceAccountSecrets.check(req, pod, policy, secrets, &result); err != nil {
+		return result, err
 	}
 
-	return patches, nil
+	return result, nil
 }
 
+// Explains the changes to the image pull secrets in audit annotations, and warns the user about every removed secret.
+// Managed are all secrets the rules require, whether they were added now or already present.
+func explainSecretChanges(result *admissionResult, managed []string) {
+	annotations := map[string][]string{
+		auditMatchedRules:   result.matchedRules,
+		auditRemovedSecrets: result.removedSecrets,
+		auditAddedSecrets:   result.addedSecrets,
+	}
+	for key, values := range annotations {
+		if len(values) == 0 {
+			continue
+		}
+		// JSON keeps the lists unambiguous, as rule IDs may contain commas
+		value, err := json.Marshal(values)
+		if err != nil {
+			continue
+		}
+		if result.auditAnnotations == nil {
+			result.auditAnnotations = map[string]string{}
+		}
+		result.auditAnnotations[key] = string(value)
+	}
 
-// Remove any ImagePullSecret that the user has added.
-// The idea is that only managed image pull secrets are allowed.
-func removeExistingPullSecrets(ns string, pod corev1.Pod) []patchOperation {
-	if len(pod.Spec.ImagePullSecrets) == 0 {
-		return nil
-	} else {
-		return []patchOperation{patchOperation{Op: "remove", Path: "/spec/imagePullSecrets"}}
+	managedList := "none"
+	if len(managed) > 0 {
+		managedList = strings.Join(managed, ", ")
+	}
+	for _, secret := range result.removedSecrets {
+		result.warnings = append(result.warnings,
+			fmt.Sprintf("imagePullSecret '%s' was removed; managed secrets: %s", secret, managedList))
 	}
 }
 
-
-// Iterates through all containers and initContainers of the Pod
-// and outputs a unique list of images this pod uses
-func getUniquePodImages(pod corev1.Pod) []string {
+// Iterates through all containers, initContainers and ephemeralContainers of the Pod
+// and outputs a unique, sorted list of images this pod uses
+func getUniquePodImages(pod decodedPod) []string {
 	// Use a map key-assignment as a uniqueness-check for images
 	imageMap := map[string]struct{}{}
 
 	//return as slice of unique images
 	var imageSlice []string
 
-
 	for _, container := range pod.Spec.Containers {
 		imageMap[container.Image] = struct{}{}
 	}
@@ -84,60 +139,95 @@ func getUniquePodImages(pod corev1.Pod) []string {
 		imageMap[container.Image] = struct{}{}
 	}
 
+	for _, container := range pod.EphemeralContainers {
+		imageMap[container.Image] = struct{}{}
+	}
 
-
-	for image, _ := range imageMap {
+	for image := range imageMap {
 		imageSlice = append(imageSlice, image)
 	}
+	sort.Strings(imageSlice)
 
 	return imageSlice
 }
 
+// Returns the smallest patch that changes the image pull secrets of the pod spec at specPath from existing to desired,
+// or nil if they are equal, so that reinvocations of the webhook do not change the pod again. A single removed or
+// appended secret is patched on its own, any other change replaces the whole list in one operation.
+func patchSecretList(specPath string, existing []string, desired []string) []patchOperation {
+	path := specPath + "/imagePullSecrets"
 
-// Takes all images this pod uses and matches it against the rules in the config.
-// Adds a unique set of imagePullSecrets as directed by the rules.
-func patchPod(imagePullSecretRules map[string]map[string]string, namespace string, images []string) []patchOperation {
-	secretsMap := map[string]struct{}{}
-	var patches []patchOperation
-
-	for namespaceRegex, imageMap := range imagePullSecretRules {
-		match, _ := regexp.MatchString(namespaceRegex, namespace)
-		if match {
-			for imageRegex, imagePullSecret := range imageMap {
-				for _, currentImage := range images {
-					imageMatch, _ := regexp.MatchString(imageRegex, currentImage)
-					if imageMatch {
-						secretsMap[imagePullSecret] = struct{}{}
-					}
-				}
+	switch {
+	case equalSecretLists(existing, desired):
+		return nil
+	case len(desired) == 0:
+		return []patchOperation{{Op: "remove", Path: path}}
+	case len(existing) == len(desired)+1:
+		for i := range existing {
+			if equalSecretLists(desired, append(existing[:i:i], existing[i+1:]...)) {
+				return []patchOperation{{Op: "remove", Path: fmt.Sprintf("%s/%d", path, i)}}
 			}
 		}
+	case len(existing) > 0 && len(desired) == len(existing)+1 && equalSecretLists(existing, desired[:len(existing)]):
+		return []patchOperation{{Op: "add", Path: path + "/-", Value: secretReference(desired[len(existing)])}}
 	}
 
-	// We need to create a fresh ImagePullSecrets array
-	// because we removed it with a patch beforehand or
-	// expect it to not exist
-	if len(secretsMap) > 0 {
-	patches = append(patches, patchOperation {
-		Op: "add",
-			Path: "/spec/imagePullSecrets",
-			Value: []string{},
-		})
+	// A missing list is added, an empty one replaced by add as well
+	op := "replace"
+	if len(existing) == 0 {
+		op = "add"
 	}
-
-	type ipsObject struct{
-		Name string `json:"name"`
+	references := make([]corev1.LocalObjectReference, len(desired))
+	for i, secret := range desired {
+		references[i] = secretReference(secret)
 	}
+	return []patchOperation{{Op: op, Path: path, Value: references}}
+}
 
-	for secret, _ := range secretsMap {
-		patches = append(patches, patchOperation{
-			Op: "add",
-			Path: "/spec/imagePullSecrets/-",
-			Value: ipsObject{Name: secret},
-		})
+func secretReference(name string) corev1.LocalObjectReference {
+	return corev1.LocalObjectReference{Name: name}
+}
+
+func equalSecretLists(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
 	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
 
+// Returns the secrets that are not in other, in the order of secrets.
+func missingSecrets(secrets []string, other []string) []string {
+	otherMap := map[string]struct{}{}
+	for _, secret := range other {
+		otherMap[secret] = struct{}{}
+	}
 
-	return patches
+	var missing []string
+	for _, secret := range secrets {
+		if _, ok := otherMap[secret]; !ok {
+			missing = append(missing, secret)
+		}
+	}
+	return missing
 }
 
+// Returns secrets with every secret of additional appended that it does not contain yet.
+func appendMissing(secrets []string, additional []string) []string {
+	result := append([]string{}, secrets...)
+	seen := map[string]struct{}{}
+	for _, secret := range secrets {
+		seen[secret] = struct{}{}
+	}
+	for _, secret := range additional {
+		if _, ok := seen[secret]; !ok {
+			seen[secret] = struct{}{}
+			result = append(result, secret)
+		}
+	}
+	return result
+}
@@ -0,0 +1,242 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	dockerHubRegistry       = `docker.io`
+	dockerHubLegacyRegistry = `index.docker.io`
+	dockerHubLibrary        = `library/`
+	defaultImageTag         = `latest`
+)
+
+var (
+	repositoryRegex = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRegex        = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegex     = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+	registryRegex   = regexp.MustCompile(`^[a-z0-9]+(?:[.-][a-z0-9]+)*(?::[0-9]+)?$`)
+)
+
+// imageReference is a container image reference split into its parts, with
+// the defaults of the container runtime applied: images without a registry are
+// pulled from Docker Hub, official Docker Hub images live in library/ and
+// images without tag or digest use the latest tag.
+type imageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// Parses and normalises an image reference as found in a container spec, e.g.
+// "nginx" becomes docker.io/library/nginx:latest.
+func parseImageReference(image string) (imageReference, error) {
+	var ref imageReference
+	remainder := image
+
+	if i := strings.Index(remainder, "@"); i >= 0 {
+		ref.Digest = remainder[i+1:]
+		remainder = remainder[:i]
+		if !digestRegex.MatchString(ref.Digest) {
+			return imageReference{}, fmt.Errorf("invalid digest %q in image %q", ref.Digest, image)
+		}
+	}
+
+	// The tag is separated by the last colon after the last slash, a colon
+	// before that belongs to the port of the registry
+	if i := strings.LastIndex(remainder, ":"); i > strings.LastIndex(remainder, "/") {
+		ref.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagRegex.MatchString(ref.Tag) {
+			return imageReference{}, fmt.Errorf("invalid tag %q in image %q", ref.Tag, image)
+		}
+	}
+
+	// The first path component is a registry if it looks like a host name
+	if i := strings.Index(remainder, "/"); i >= 0 && isRegistryHost(remainder[:i]) {
+		ref.Registry = strings.ToLower(remainder[:i])
+		ref.Repository = remainder[i+1:]
+	} else {
+		ref.Registry = dockerHubRegistry
+		ref.Repository = remainder
+	}
+
+	if ref.Registry == dockerHubLegacyRegistry {
+		ref.Registry = dockerHubRegistry
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = dockerHubLibrary + ref.Repository
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultImageTag
+	}
+
+	if !registryRegex.MatchString(ref.Registry) {
+		return imageReference{}, fmt.Errorf("invalid registry %q in image %q", ref.Registry, image)
+	}
+	if !repositoryRegex.MatchString(ref.Repository) {
+		return imageReference{}, fmt.Errorf("invalid repository %q in image %q", ref.Repository, image)
+	}
+
+	return ref, nil
+}
+
+// Docker only treats the first path component as registry if it contains a
+// dot or a port, or is localhost.
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// Returns the fully qualified reference, e.g. docker.io/library/nginx:latest.
+func (r imageReference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// ImageMatcher matches images of a pod. It is either a Regex that is matched
+// against the image as written in the pod spec, or a combination of the
+// parsed image's Registry, Repository and Tag. In YAML a plain string is
+// taken as Regex.
+//
+// Registry is compared with the normalised registry host (including the port),
+// a leading "*." matches any subdomain. Repository and Tag are regexes that
+// have to match the whole repository path or tag. Fields that are not set
+// match anything.
+type ImageMatcher struct {
+	Regex      string `yaml:"regex,omitempty"`
+	Registry   string `yaml:"registry,omitempty"`
+	Repository string `yaml:"repository,omitempty"`
+	Tag        string `yaml:"tag,omitempty"`
+}
+
+func (m *ImageMatcher) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var regex string
+	if err := unmarshal(&regex); err == nil {
+		*m = ImageMatcher{Regex: regex}
+		return nil
+	}
+
+	// Unmarshal into a type without the UnmarshalYAML method to avoid recursion
+	type plain ImageMatcher
+	return unmarshal((*plain)(m))
+}
+
+// imageMatcher is a compiled ImageMatcher.
+type imageMatcher struct {
+	source     string
+	regex      *regexp.Regexp
+	registry   string
+	repository *regexp.Regexp
+	tag        *regexp.Regexp
+}
+
+// Validates the matcher and compiles its regexes.
+func (m ImageMatcher) compile(path string, errs *configErrors) imageMatcher {
+	structured := m.Registry != "" || m.Repository != "" || m.Tag != ""
+
+	if m.Regex != "" {
+		if structured {
+			errs.add(path, "regex cannot be combined with registry, repository or tag")
+		}
+		return imageMatcher{source: m.Regex, regex: errs.regexp(path, m.Regex)}
+	}
+	if !structured {
+		errs.add(path, "one of regex, registry, repository or tag is required")
+	}
+
+	compiled := imageMatcher{source: m.String(), registry: strings.ToLower(m.Registry)}
+	if compiled.registry != "" && !registryRegex.MatchString(strings.TrimPrefix(compiled.registry, "*.")) {
+		errs.add(path+".registry", "invalid registry host %q", m.Registry)
+	}
+	if m.Repository != "" {
+		compiled.repository = errs.regexp(path+".repository", "^(?:"+m.Repository+")$")
+	}
+	if m.Tag != "" {
+		compiled.tag = errs.regexp(path+".tag", "^(?:"+m.Tag+")$")
+	}
+	return compiled
+}
+
+// Describes the matcher in error messages.
+func (m ImageMatcher) String() string {
+	if m.Regex != "" {
+		return m.Regex
+	}
+
+	var parts []string
+	if m.Registry != "" {
+		parts = append(parts, "registry="+m.Registry)
+	}
+	if m.Repository != "" {
+		parts = append(parts, "repository="+m.Repository)
+	}
+	if m.Tag != "" {
+		parts = append(parts, "tag="+m.Tag)
+	}
+	return strings.Join(parts, " ")
+}
+
+// podImage is an image of a pod, parsed once for all matchers.
+type podImage struct {
+	raw    string
+	ref    imageReference
+	parsed bool
+}
+
+func newPodImage(image string) podImage {
+	ref, err := parseImageReference(image)
+	return podImage{raw: image, ref: ref, parsed: err == nil}
+}
+
+// Regex matchers match the image as written in the pod spec, structured
+// matchers match its parsed parts and never match images that cannot be parsed.
+func (m imageMatcher) matches(image podImage) bool {
+	if m.regex != nil {
+		return m.regex.MatchString(image.raw)
+	}
+	if !image.parsed {
+		return false
+	}
+
+	ref := image.ref
+	if m.registry != "" {
+		if strings.HasPrefix(m.registry, "*.") {
+			if !strings.HasSuffix(ref.Registry, m.registry[1:]) {
+				return false
+			}
+		} else if ref.Registry != m.registry {
+			return false
+		}
+	}
+	if m.repository != nil && !m.repository.MatchString(ref.Repository) {
+		return false
+	}
+	if m.tag != nil && !m.tag.MatchString(ref.Tag) {
+		return false
+	}
+	return true
+}
+
+// Checks whether any of the matchers matches the image.
+func matchesAnyImage(matchers []imageMatcher, image podImage) bool {
+	for _, matcher := range matchers {
+		if matcher.matches(image) {
+			return true
+		}
+	}
+	return false
+}
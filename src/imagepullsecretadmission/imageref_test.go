@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	tests := map[string]imageReference{
+		"nginx":                                {"docker.io", "library/nginx", "latest", ""},
+		"nginx:1.17":                           {"docker.io", "library/nginx", "1.17", ""},
+		"docker.io/library/nginx":              {"docker.io", "library/nginx", "latest", ""},
+		"index.docker.io/library/nginx:latest": {"docker.io", "library/nginx", "latest", ""},
+		"mmlac/kubetils":                       {"docker.io", "mmlac/kubetils", "latest", ""},
+		"gcr.io/project/app:v1":                {"gcr.io", "project/app", "v1", ""},
+		"GCR.io/project/app":                   {"gcr.io", "project/app", "latest", ""},
+		"localhost/app":                        {"localhost", "app", "latest", ""},
+		"registry:5000/team/app:v2":            {"registry:5000", "team/app", "v2", ""},
+		"quay.io/team/app@" + digest:           {"quay.io", "team/app", "", digest},
+		"quay.io/team/app:v3@" + digest:        {"quay.io", "team/app", "v3", digest},
+	}
+
+	for image, want := range tests {
+		ref, err := parseImageReference(image)
+		if err != nil {
+			t.Errorf("%s: Error: Wanted nil, got %v", image, err)
+			continue
+		}
+		if !reflect.DeepEqual(ref, want) {
+			t.Errorf("%s: Wanted %+v, got %+v", image, want, ref)
+		}
+	}
+
+	if ref, _ := parseImageReference("nginx"); ref.String() != "docker.io/library/nginx:latest" {
+		t.Errorf("Wanted normalised docker.io/library/nginx:latest, got %s", ref)
+	}
+}
+
+func TestParseImageReferenceInvalid(t *testing.T) {
+	for _, image := range []string{"", "gcr.io/", "Nginx", "nginx:", "nginx@sha256:abc", "gcr.io/app:v1:v2"} {
+		if ref, err := parseImageReference(image); err == nil {
+			t.Errorf("%q: Wanted error, got %+v", image, ref)
+		}
+	}
+}
+
+func TestImageMatcher(t *testing.T) {
+	tests := []struct {
+		matcher ImageMatcher
+		image   string
+		want    bool
+	}{
+		{ImageMatcher{Registry: "gcr.io"}, "gcr.io/project/app", true},
+		{ImageMatcher{Registry: "gcr.io"}, "evilgcr.io.attacker.com/project/app", false},
+		{ImageMatcher{Registry: "gcr.io"}, "eu.gcr.io/project/app", false},
+		{ImageMatcher{Registry: "*.gcr.io"}, "eu.gcr.io/project/app", true},
+		{ImageMatcher{Registry: "*.gcr.io"}, "gcr.io/project/app", false},
+		{ImageMatcher{Registry: "*.gcr.io"}, "eu.gcr.io.attacker.com/project/app", false},
+		{ImageMatcher{Registry: "docker.io", Repository: "library/.*"}, "nginx", true},
+		{ImageMatcher{Registry: "docker.io", Repository: "library/.*"}, "index.docker.io/library/nginx:latest", true},
+		{ImageMatcher{Registry: "docker.io", Repository: "library/.*"}, "mmlac/kubetils", false},
+		{ImageMatcher{Repository: "project/app"}, "gcr.io/project/app-evil", false},
+		{ImageMatcher{Registry: "gcr.io", Tag: `v\d+`}, "gcr.io/project/app:v12", true},
+		{ImageMatcher{Registry: "gcr.io", Tag: `v\d+`}, "gcr.io/project/app", false},
+		{ImageMatcher{Registry: "gcr.io"}, "gcr.io/Invalid", false},
+		{ImageMatcher{Regex: "gcr.io"}, "evilgcr.io.attacker.com/project/app", true},
+	}
+
+	for _, test := range tests {
+		var errs configErrors
+		matcher := test.matcher.compile("images[0]", &errs)
+		if len(errs) > 0 {
+			t.Fatalf("%s: Error: Wanted nil, got %v", test.matcher, errs)
+		}
+		if got := matcher.matches(newPodImage(test.image)); got != test.want {
+			t.Errorf("%s on %s: Wanted %v, got %v", test.matcher, test.image, test.want, got)
+		}
+	}
+}
+
+const imageMatcherYAML = `
+rules:
+- namespaces: [".*"]
+  images:
+  - registry: gcr.io
+    repository: team-a/.*
+  - "^quay.io/team-a/"
+  secrets: ["team-a"]
+imageAdmissionRules:
+  ".*":
+  - registry: "*.gcr.io"
+  - regex: "^quay.io/"
+`
+
+func TestImageMatcherConfig(t *testing.T) {
+	config, err := parseConfig([]byte(imageMatcherYAML))
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+
+	for image, want := range map[string]bool{
+		"gcr.io/team-a/app":        true,
+		"quay.io/team-a/app":       true,
+		"gcr.io/team-b/app":        false,
+		"evilgcr.io/team-a/app":    false,
+		"gcr.io.evil.com/team-a/x": false,
+	} {
+		secrets, _ := evaluateSecretRules(config.secretRules, "testns", []string{image})
+		if got := len(secrets) == 1; got != want {
+			t.Errorf("%s: Wanted match %v, got secrets %v", image, want, secrets)
+		}
+	}
+
+	_, err = admitPodImages(imagePodRequest(t, "testns", "eu.gcr.io/app", "nginx"), config)
+	if err == nil || !strings.Contains(err.Error(), "nginx (allowed registries: ^quay.io/, registry=*.gcr.io)") {
+		t.Errorf("Error: Wanted rejection of nginx, got %v", err)
+	}
+}
+
+func TestImageMatcherInvalid(t *testing.T) {
+	const content = `
+rules:
+- namespaces: [".*"]
+  images:
+  - regex: "^gcr.io/"
+    registry: gcr.io
+  - tag: "("
+  - registry: "gcr.io/project"
+  - {}
+  secrets: ["a"]
+`
+	want := []string{
+		`rules[0].images[0]: regex cannot be combined with registry, repository or tag`,
+		`rules[0].images[1].tag: invalid regex`,
+		`rules[0].images[2].registry: invalid registry host "gcr.io/project"`,
+		`rules[0].images[3]: one of regex, registry, repository or tag is required`,
+	}
+
+	_, err := parseConfig([]byte(content))
+	if err == nil {
+		t.Fatal("Error: Wanted errors, got nil")
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("Error: Wanted error containing '%s', got %v", w, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return logLevel(level), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("invalid log level %q, must be one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// logFields are added to a log line as additional JSON keys.
+type logFields map[string]interface{}
+
+// logSink is the output shared by a logger and all loggers derived from it.
+type logSink struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level int32
+}
+
+// jsonLogger writes one JSON object per line with the time, level, message and its fields.
+type jsonLogger struct {
+	sink   *logSink
+	fields logFields
+}
+
+// The logger of the webhook. Its level is set from the config.
+var logger = newJSONLogger(os.Stderr, levelInfo)
+
+func newJSONLogger(out io.Writer, level logLevel) *jsonLogger {
+	return &jsonLogger{sink: &logSink{out: out, level: int32(level)}}
+}
+
+func (l *jsonLogger) setLevel(level logLevel) {
+	atomic.StoreInt32(&l.sink.level, int32(level))
+}
+
+// with returns a logger that adds the fields to every line, on top of the fields of l.
+func (l *jsonLogger) with(fields logFields) *jsonLogger {
+	merged := logFields{}
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &jsonLogger{sink: l.sink, fields: merged}
+}
+
+func (l *jsonLogger) Debugf(format string, args ...interface{}) {
+	l.log(levelDebug, nil, format, args...)
+}
+
+func (l *jsonLogger) Infof(format string, args ...interface{}) {
+	l.log(levelInfo, nil, format, args...)
+}
+
+func (l *jsonLogger) Warnf(format string, args ...interface{}) {
+	l.log(levelWarn, nil, format, args...)
+}
+
+func (l *jsonLogger) Errorf(format string, args ...interface{}) {
+	l.log(levelError, nil, format, args...)
+}
+
+// Fatalf logs at error level and exits.
+func (l *jsonLogger) Fatalf(format string, args ...interface{}) {
+	l.log(levelError, nil, format, args...)
+	os.Exit(1)
+}
+
+// log writes a line if the level is enabled. Fields given here are only added to this line.
+func (l *jsonLogger) log(level logLevel, fields logFields, format string, args ...interface{}) {
+	if int32(level) < atomic.LoadInt32(&l.sink.level) {
+		return
+	}
+	if len(fields) > 0 {
+		l = l.with(fields)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, fmt.Sprintf(format, args...))
+
+	keys := make([]string, 0, len(l.fields))
+	for key := range l.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteString(",")
+		writeJSON(&buf, key)
+		buf.WriteString(":")
+		writeJSON(&buf, l.fields[key])
+	}
+	buf.WriteString("}\n")
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.out.Write(buf.Bytes())
+}
+
+// writeJSON writes the value as JSON, or its error message as a string if it cannot be marshalled.
+func writeJSON(buf *bytes.Buffer, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprintf("%v", value))
+	}
+	buf.Write(encoded)
+}
+
+// requestLogger returns a logger that adds the fields identifying an admission request to every line,
+// so they can be correlated with the API server audit log.
+func requestLogger(req *admissionRequest) *jsonLogger {
+	fields := logFields{
+		"uid":       string(req.UID),
+		"kind":      req.Kind.Kind,
+		"namespace": req.Namespace,
+		"operation": string(req.Operation),
+		"user":      req.UserInfo.Username,
+	}
+	if req.SubResource != "" {
+		fields["subResource"] = req.SubResource
+	}
+
+	name, generateName := requestObjectName(req)
+	if name != "" {
+		fields["name"] = name
+	} else if generateName != "" {
+		fields["generateName"] = generateName
+	}
+
+	return logger.with(fields)
+}
+
+// requestObjectName returns the name of the object of the request. Objects that are created usually have no name in
+// the request yet, so it is taken from the object, along with its generateName.
+func requestObjectName(req *admissionRequest) (string, string) {
+	if req.Name != "" {
+		return req.Name, ""
+	}
+
+	var object struct {
+		Metadata struct {
+			Name         string `json:"name"`
+			GenerateName string `json:"generateName"`
+		} `json:"metadata"`
+	}
+	if json.Unmarshal(req.Object.Raw, &object) != nil {
+		return "", ""
+	}
+	return object.Metadata.Name, object.Metadata.GenerateName
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Replaces the logger of the webhook with one writing to the returned buffer,
+// until the returned function is called.
+func captureLogs(level logLevel) (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	previous := logger
+	logger = newJSONLogger(&buf, level)
+	return &buf, func() { logger = previous }
+}
+
+// Decodes every line of the captured logs.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+			t.Fatalf("Error: Wanted JSON log line, got %q: %v", line, err)
+		}
+		lines = append(lines, decoded)
+	}
+	return lines
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := newJSONLogger(&buf, levelInfo).with(logFields{"uid": "test-uid"})
+
+	log.Debugf("hidden")
+	log.Infof("shown %d", 1)
+	log.log(levelWarn, logFields{"secrets": []string{"a", "b"}}, "with fields")
+
+	lines := logLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("Result: Wanted 2 lines above debug level, got %v", buf.String())
+	}
+	if lines[0]["level"] != "info" || lines[0]["msg"] != "shown 1" || lines[0]["uid"] != "test-uid" {
+		t.Errorf("Result: Wanted info line with uid, got %v", lines[0])
+	}
+	if lines[1]["level"] != "warn" || !reflect.DeepEqual(lines[1]["secrets"], []interface{}{"a", "b"}) {
+		t.Errorf("Result: Wanted warn line with secrets, got %v", lines[1])
+	}
+	if _, ok := lines[0]["secrets"]; ok {
+		t.Errorf("Result: Wanted line fields only on their line, got %v", lines[0])
+	}
+	if _, ok := lines[0]["time"]; !ok {
+		t.Errorf("Result: Wanted time, got %v", lines[0])
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := map[string]logLevel{"debug": levelDebug, "INFO": levelInfo, "warn": levelWarn, "Error": levelError}
+	for name, want := range tests {
+		if level, err := parseLogLevel(name); err != nil || level != want {
+			t.Errorf("%s: Wanted %v, got %v, %v", name, want, level, err)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("Error: Wanted error for invalid level, got nil")
+	}
+}
+
+func TestRequestSummaryLog(t *testing.T) {
+	buf, restore := captureLogs(levelInfo)
+	defer restore()
+
+	request := podWithSecretsRequest(t, "testns", "my-creds")
+	request.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	request.Operation = v1beta1.Create
+	request.UserInfo = authenticationv1.UserInfo{Username: "alice"}
+	httpRequest := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBody(t, admissionV1, request)))
+	httpRequest.Header.Add("Content-Type", jsonContentType)
+	if recorder := makeRequest(httpRequest, defaultConfig); recorder.Code != http.StatusOK {
+		t.Fatalf("Status: Wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("Result: Wanted a single summary line, got %v", buf.String())
+	}
+	want := map[string]interface{}{
+		"uid":            "test-uid",
+		"kind":           "Pod",
+		"namespace":      "testns",
+		"operation":      "CREATE",
+		"user":           "alice",
+		"endpoint":       "/mutate",
+		"allowed":        true,
+		"removedSecrets": []interface{}{"my-creds"},
+		"addedSecrets":   []interface{}{"testSecret"},
+		"matchedRules":   []interface{}{`imagePullSecretRules[".*"][".*"]`},
+	}
+	for key, value := range want {
+		if !reflect.DeepEqual(lines[0][key], value) {
+			t.Errorf("%s: Wanted %v, got %v", key, value, lines[0][key])
+		}
+	}
+	if _, ok := lines[0]["durationMs"]; !ok {
+		t.Errorf("Result: Wanted durationMs, got %v", lines[0])
+	}
+}
+
+func TestRequestLoggerName(t *testing.T) {
+	buf, restore := captureLogs(levelDebug)
+	defer restore()
+
+	request := workloadRequest(t, deploymentResource, "test")
+	requestLogger(request).Infof("test")
+	request.Name = "named"
+	requestLogger(request).Infof("test")
+	request.Name = ""
+	request.Object.Raw = []byte(`{"metadata":{"generateName":"app-"}}`)
+	requestLogger(request).Infof("test")
+
+	lines := logLines(t, buf)
+	if lines[0]["name"] != "app" {
+		t.Errorf("Object name: Wanted app, got %v", lines[0])
+	}
+	if lines[1]["name"] != "named" {
+		t.Errorf("Request name: Wanted named, got %v", lines[1])
+	}
+	if _, ok := lines[2]["name"]; ok || lines[2]["generateName"] != "app-" {
+		t.Errorf("Generated name: Wanted generateName app-, got %v", lines[2])
+	}
+}
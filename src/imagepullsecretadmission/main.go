@@ -6,34 +6,27 @@ Licensed under the MIT license. See LICENSE file in the project root for details
 /*  TODOS / FUTURE POSSIBLE FEATURES
 
     TODO tests O:)
-    TODO Add ability to exclude more namespaces via config
-    TODO Add ability to have an override flag for removing pull secrets. Needs another admission
-         controller to manage who is allowed to add these annotations or use it as emergency flag
-         under discretion.
-    TODO Have a second set of rules that does image admission itself, i.e. has a regex of
-         namespaceRegex -> imageRegex
-         if there is no match, reject the pod.
-         If YAML is guaranteed to keep the order in the parsing we can do more complex allow/deny
-         override rules. Probably not "most specific wins"
-         To reject a request, our controller logic needs to return an error back to the handling logic
-         import "errors"   errors.New("error message")
+    TODO Image admission rules are allow-only. If YAML is guaranteed to keep the order in the
+         parsing we can do more complex allow/deny override rules. Probably not "most specific wins"
     TODO Consider wrapping all dependencies into a server type
 */
 
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"log"
 	"net/http"
-	"path/filepath"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-
 const (
-	tlsDir      = `/run/secrets/tls`
+	// File names of a key pair in a directory, the same as in a kubernetes.io/tls secret
 	tlsCertFile = `tls.crt`
 	tlsKeyFile  = `tls.key`
 	configFile  = `/etc/ipsa/config.yaml`
@@ -41,42 +34,106 @@ const (
 
 var (
 	podResource = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
-)
-
-type Config struct {
-	Application          map[string]string  `yaml:"application,omitempty"`
-	ImagePullSecretRules map[string]map[string]string `yaml:"imagePullSecretRules"`
-}
 
+	// The admission controllers by the path they are served on.
+	admitFuncs = map[string]admitFunc{
+		"/mutate":   reportOnly(manageImagePullSecrets),
+		"/validate": admitPodImages,
+	}
 
+	// Subcommands of the binary, which runs the webhook server without one.
+	commands = map[string]func(args []string, stdin io.Reader, stdout io.Writer) error{
+		"certs":   runCerts,
+		"explain": runExplain,
+		"replay":  runReplay,
+	}
+)
 
-func Mux(config Config) *http.ServeMux {
+// Mux serves the webhooks and the probes. The replica is ready once the config is loaded and all
+// further checks pass.
+func Mux(configs *configStore, checks ...readinessCheck) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.Handle("/mutate", admitFuncHandler(config, manageImagePullSecrets))
+	for path, admit := range admitFuncs {
+		mux.Handle(path, admitFuncHandler(configs, admit))
+	}
+	mux.Handle("/healthz", healthzHandler())
+	mux.Handle("/readyz", readyzHandler(append([]readinessCheck{configReady(configs)}, checks...)...))
 	return mux
 }
 
-
 // Start http server, pass request through admissionFuncHandler to parse request,
 // run applySecurityDefaults function and form the proper HTTP response.
 func main() {
-	configFileContent, err := ioutil.ReadFile(configFile)
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command %s\n", os.Args[1])
+			os.Exit(2)
+		}
+		if err := command(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Settings given by the environment and flags override the config
+	configPath, overrides, err := parseSettings(os.Args[1:], os.LookupEnv, os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	settingOverrides = overrides
+
+	config, checksum, err := loadConfigFile(configPath)
 	if err != nil {
-		log.Fatalf("Cannot read config file from file %s: %s. Aborting...", configFile, err.Error())
+		logger.Fatalf("Cannot load config file %s: %s. Aborting...", configPath, err.Error())
+	}
+	logger.setLevel(config.logLevel)
+	settings := config.Application
+
+	// Keep the rules up to date with the mounted ConfigMap
+	configs := newConfigStore(config)
+	watcher := newConfigWatcher(configPath, configs, checksum)
+	go watcher.run(settings.ConfigReloadInterval, make(chan struct{}))
+
+	// Metrics are scraped over plain HTTP on a separate port
+	go func() {
+		logger.Fatalf("Metrics server failed: %v", newMetricsServer(settings).ListenAndServe())
+	}()
+
+	// Self-managed certificates are generated before the key pair is loaded, and rotated in the background
+	if err := startCertManager(config, make(chan struct{})); err != nil {
+		logger.Fatalf("Cannot generate certificate %s: %v. Aborting...", settings.TLSCertFile, err)
 	}
 
-	var config Config
-	yaml.Unmarshal(configFileContent, &config)
+	// ServiceAccounts are looked up through the API server, their image pull secrets are cached
+	if err := startServiceAccountCheck(settings); err != nil {
+		logger.Fatalf("Cannot look up ServiceAccounts: %v. Aborting...", err)
+	}
 
-	certPath := filepath.Join(tlsDir, tlsCertFile)
-	keyPath  := filepath.Join(tlsDir, tlsKeyFile)
+	// The key pair is reloaded when the secret is renewed or the certificates are rotated
+	certs := newCertReloader(settings.TLSCertFile, settings.TLSKeyFile, settings.CertReloadInterval)
+	if _, err := certs.certificate(); err != nil {
+		logger.Fatalf("Cannot load TLS key pair %s: %v. Aborting...", settings.TLSCertFile, err)
+	}
 
-	mux := Mux(config)
- 	server := &http.Server{
-		// We listen on port 8443 such that we do not need root privileges or extra capabilities for this server.
-		// The Service object will take care of mapping this port to the HTTPS port 443.
-		Addr:    ":8443",
-		Handler: mux,
+	// SIGTERM drains the in-flight requests before the process exits
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	drain := &draining{}
+
+	mux := Mux(configs, certificateReady(certs), notDraining(drain))
+	// We listen on port 8443 by default such that we do not need root privileges or extra capabilities for this
+	// server. The Service object will take care of mapping this port to the HTTPS port 443.
+	server := newServer(settings, mux, certs)
+	serve := func() error {
+		return server.ListenAndServeTLS("", "")
+	}
+	if err := serveGracefully(server, serve, drain, settings, signals); err != nil {
+		logger.Fatalf("Webhook server failed: %v", err)
 	}
-	log.Fatal(server.ListenAndServeTLS(certPath, keyPath))
+	captures.wait()
 }
@@ -1,22 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"net/http"
 	"net/http/httptest"
-	"testing"
-	"errors"
+	"reflect"
 	"strings"
-	"encoding/json"
-	"k8s.io/api/admission/v1beta1"
-
+	"testing"
 )
 
-
-
-var defaultConfig Config = Config {
-	imagePullSecretRules: map[string]map[string]string {
-		".*": map[string]string {".*": "testSecret"},
+var defaultConfig Config = mustCompile(Config{
+	ImagePullSecretRules: map[string]map[string]secretList{
+		".*": map[string]secretList{".*": {"testSecret"}},
 	},
+})
+
+// Compiles a config literal the same way a loaded config file is compiled.
+func mustCompile(config Config) Config {
+	compiled, err := config.compile()
+	if err != nil {
+		panic(err)
+	}
+	return compiled
 }
 
 func kubeSystemDefaultBody() string {
@@ -32,32 +45,115 @@ func kubeSystemDefaultBody() string {
 	return string(js)
 }
 
+// Builds an AdmissionReview of the given apiVersion for creating a pod with
+// a single container in the given namespace.
+func podReviewBody(apiVersion string, namespace string) string {
+	pod, err := json.Marshal(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Image: "test"}},
+		},
+	})
+	if err != nil {
+		panic("Unable to Marshal the pod object to JSON")
+	}
+
+	review := admissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: "AdmissionReview"},
+		Request: &admissionRequest{
+			UID:       "test-uid",
+			Namespace: namespace,
+			Resource:  podResource,
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: pod},
+		},
+	}
+	js, err := json.Marshal(review)
+	if err != nil {
+		panic("Unable to Marshal the podReviewBody AdmissionReview object to JSON")
+	}
+	return string(js)
+}
+
+// Wraps the request into an AdmissionReview of the given apiVersion.
+func reviewBody(t *testing.T, apiVersion string, request *admissionRequest) []byte {
+	body, err := json.Marshal(admissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: admissionReviewKind},
+		Request:  request,
+	})
+	if err != nil {
+		t.Fatalf("Failed JSON marshal with %v", err)
+	}
+	return body
+}
+
+// Builds a CREATE AdmissionRequest for the pod in its namespace.
+func podRequest(t *testing.T, pod corev1.Pod) *admissionRequest {
+	return objectRequest(t, podResource, pod.Namespace, pod)
+}
+
+// Builds a CREATE AdmissionRequest for a workload of the resource with the
+// name and namespace of the pod, whose pod template has the annotations,
+// labels and spec of the pod.
+func templateRequest(t *testing.T, resource metav1.GroupVersionResource, pod corev1.Pod) *admissionRequest {
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: pod.Labels, Annotations: pod.Annotations},
+		Spec:       pod.Spec,
+	}
+
+	var spec interface{} = map[string]interface{}{"template": template}
+	if resource.Resource == "cronjobs" {
+		spec = map[string]interface{}{
+			"schedule":    "@hourly",
+			"jobTemplate": map[string]interface{}{"spec": spec},
+		}
+	}
+
+	return objectRequest(t, resource, pod.Namespace, map[string]interface{}{
+		"metadata": metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+		"spec":     spec,
+	})
+}
+
+func objectRequest(t *testing.T, resource metav1.GroupVersionResource, namespace string, object interface{}) *admissionRequest {
+	jsonbytes, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("Failed JSON marshal with %v", err)
+	}
+
+	return &admissionRequest{
+		UID:       "test-uid",
+		Namespace: namespace,
+		Resource:  resource,
+		Operation: v1beta1.Create,
+		Object:    runtime.RawExtension{Raw: jsonbytes},
+	}
+}
 
 // io.Reader that returns an error to test the body not being
 // able to be read
 type errReader int
+
 func (errReader) Read(p []byte) (n int, err error) {
 	return 0, errors.New("test error")
 }
 
-
-
 // Test the 'happy path' of the HTTP handling code without testing the
 // functionality of the admission handler
 func blankFuncMux(config Config) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.Handle("/mutate", admitFuncHandler(config,
-		func(*v1beta1.AdmissionRequest, Config) ([]patchOperation, error){
-			return nil, nil}))
+	mux.Handle("/mutate", admitFuncHandler(newConfigStore(config),
+		func(*admissionRequest, Config) (admissionResult, error) {
+			return admissionResult{}, nil
+		}))
 	return mux
 }
 
-
 // Create a request handler for the Mux we use in the server and apply the request
 // to it. Return the response recorder for evaluation of the result.
-func makeRequest(request *http.Request, conf Config) *httptest.ResponseRecorder  {
+func makeRequest(request *http.Request, conf Config) *httptest.ResponseRecorder {
 	recorder := httptest.NewRecorder()
-	handler := Mux(conf)
+	handler := Mux(newConfigStore(conf))
 	handler.ServeHTTP(recorder, request)
 	return recorder
 }
@@ -67,7 +163,7 @@ func TestForbiddenHttpVerbs(t *testing.T) {
 	const wantStatus, wantString = http.StatusMethodNotAllowed, "invalid method"
 	config := defaultConfig
 
-	notAllowedVerbs := []string {"GET", "HEAD", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+	notAllowedVerbs := []string{"GET", "HEAD", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
 
 	for _, verb := range notAllowedVerbs {
 		t.Run(verb, func(t *testing.T) {
@@ -86,8 +182,6 @@ func TestForbiddenHttpVerbs(t *testing.T) {
 	}
 }
 
-
-
 // Tests a proper return if the server fails to read the body
 func TestEmptyBody(t *testing.T) {
 	const wantStatus, wantString = http.StatusBadRequest, "could not read request body"
@@ -106,7 +200,36 @@ func TestEmptyBody(t *testing.T) {
 	}
 }
 
+// Tests that AdmissionReviews larger than the limit are rejected, whether their length is known upfront or not
+func TestRequestTooLarge(t *testing.T) {
+	const wantStatus, wantString = http.StatusRequestEntityTooLarge, "exceeds the limit of 16 bytes"
+	config := defaultConfig
+	config.Application.MaxRequestBytes = 16
+
+	bodies := map[string]io.Reader{
+		"Content-Length": strings.NewReader(`{"apiVersion": "admission.k8s.io/v1"}`),
+		"Chunked":        ioutil.NopCloser(strings.NewReader(`{"apiVersion": "admission.k8s.io/v1"}`)),
+	}
+
+	for name, body := range bodies {
+		body := body
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/mutate", body)
+			req.Header.Add("Content-Type", jsonContentType)
 
+			recorder := makeRequest(req, config)
+
+			if status := recorder.Code; status != wantStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, wantStatus)
+			}
+			if body := recorder.Body.String(); !strings.Contains(body, wantString) {
+				t.Errorf("handler returned wrong body: got '%v' want containing '%v'",
+					body, wantString)
+			}
+		})
+	}
+}
 
 // Tests that the wrong Content Type will be rejected
 func TestWrongContentType(t *testing.T) {
@@ -119,7 +242,7 @@ func TestWrongContentType(t *testing.T) {
 	}
 
 	for name, hdr := range headers {
-		t.Run(name, func(t *testing.T){
+		t.Run(name, func(t *testing.T) {
 			req := httptest.NewRequest("POST", "/mutate", strings.NewReader(""))
 			req.Header = hdr
 
@@ -158,8 +281,97 @@ func TestProperlyFormedRequest(t *testing.T) {
 	}
 }
 
+// Tests that both admission.k8s.io/v1beta1 and v1 reviews are answered in the
+// version they were sent in, with a JSONPatch patch type
+func TestAdmissionReviewVersions(t *testing.T) {
+	config := defaultConfig
 
+	for _, version := range []string{"admission.k8s.io/v1beta1", "admission.k8s.io/v1"} {
+		t.Run(version, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/mutate", strings.NewReader(podReviewBody(version, "testns")))
+			req.Header = map[string][]string{"Content-Type": {"application/json"}}
 
+			recorder := makeRequest(req, config)
+
+			if status := recorder.Code; status != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v",
+					status, http.StatusOK)
+			}
+
+			var review admissionReview
+			if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if review.APIVersion != version || review.Kind != "AdmissionReview" {
+				t.Errorf("response has wrong type: got %s %s want %s AdmissionReview",
+					review.APIVersion, review.Kind, version)
+			}
+			if review.Response == nil || review.Response.UID != "test-uid" || !review.Response.Allowed {
+				t.Fatalf("response is not an allowed response for the request: got %+v", review.Response)
+			}
+			if review.Response.PatchType == nil || *review.Response.PatchType != v1beta1.PatchTypeJSONPatch {
+				t.Errorf("response has wrong patch type: got %v want %v",
+					review.Response.PatchType, v1beta1.PatchTypeJSONPatch)
+			}
+		})
+	}
+}
+
+// Tests that the changes are explained in audit annotations for both versions,
+// and in warnings only for v1, which is the first version to support them
+func TestAdmissionReviewExplanations(t *testing.T) {
+	wantAnnotations := map[string]string{
+		auditMatchedRules:   `["imagePullSecretRules[\".*\"][\".*\"]"]`,
+		auditRemovedSecrets: `["my-creds"]`,
+		auditAddedSecrets:   `["testSecret"]`,
+	}
+	wantWarnings := map[string][]string{
+		admissionV1beta1: nil,
+		admissionV1:      {"imagePullSecret 'my-creds' was removed; managed secrets: testSecret"},
+	}
+
+	for version, warnings := range wantWarnings {
+		version, warnings := version, warnings
+		t.Run(version, func(t *testing.T) {
+			body := reviewBody(t, version, podWithSecretsRequest(t, "testns", "my-creds"))
+			req := httptest.NewRequest("POST", "/mutate", bytes.NewReader(body))
+			req.Header = map[string][]string{"Content-Type": {"application/json"}}
+
+			recorder := makeRequest(req, defaultConfig)
+
+			var review admissionReview
+			if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil || review.Response == nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if !reflect.DeepEqual(review.Response.AuditAnnotations, wantAnnotations) {
+				t.Errorf("Audit annotations: Wanted %v, got %v", wantAnnotations, review.Response.AuditAnnotations)
+			}
+			if !reflect.DeepEqual(review.Response.Warnings, warnings) {
+				t.Errorf("Warnings: Wanted %v, got %v", warnings, review.Response.Warnings)
+			}
+		})
+	}
+}
+
+// Tests that reviews of an unknown version are rejected
+func TestUnsupportedAdmissionReviewVersion(t *testing.T) {
+	const wantStatus, wantString = http.StatusBadRequest, "unsupported apiVersion"
+	config := defaultConfig
+
+	req := httptest.NewRequest("POST", "/mutate", strings.NewReader(podReviewBody("admission.k8s.io/v2", "testns")))
+	req.Header = map[string][]string{"Content-Type": {"application/json"}}
+
+	recorder := makeRequest(req, config)
+
+	if status := recorder.Code; status != wantStatus {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, wantStatus)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, wantString) {
+		t.Errorf("handler returned wrong body: got '%v' want containing '%v'",
+			body, wantString)
+	}
+}
 
 // func TestValidKubeSystemRequest(t *testing.T) {
 // 	config  := defaultConfig
@@ -175,7 +387,6 @@ func TestProperlyFormedRequest(t *testing.T) {
 // 			status, http.StatusOK)
 // 	}
 
-
 // 	// Check the response body is what we expect.
 // 	expected := `{"alive": true}`
 // 	if recorder.Body.String() != expected {
@@ -0,0 +1,348 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsContentType = `text/plain; version=0.0.4; charset=utf-8`
+
+	outcomeAllowed = "allowed"
+	outcomeDenied  = "denied"
+	outcomeError   = "error"
+
+	reloadSuccess = "success"
+	reloadFailure = "failure"
+)
+
+// Buckets of the latency histograms in seconds, the same as the Prometheus client defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// The metrics of the webhook, exposed on /metrics of the metrics server.
+var (
+	admissionRequests = newCounterVec("ipsa_admission_requests_total",
+		"Admission requests handled, by endpoint, operation, namespace and outcome.",
+		"endpoint", "operation", "namespace", "outcome")
+	admissionDuration = newHistogramVec("ipsa_admission_request_duration_seconds",
+		"Time taken to handle admission requests.", latencyBuckets,
+		"endpoint")
+	secretsRemoved = newCounterVec("ipsa_image_pull_secrets_removed_total",
+		"User image pull secrets removed from pods.",
+		"namespace")
+	secretsAdded = newCounterVec("ipsa_image_pull_secrets_added_total",
+		"Managed image pull secrets added to pods.",
+		"namespace")
+	ruleHits = newCounterVec("ipsa_rule_hits_total",
+		"Admission requests in which a secret rule matched.",
+		"rule")
+	reportOnlyDecisions = newCounterVec("ipsa_report_only_decisions_total",
+		"Admission requests that were admitted unchanged in report-only mode, by the decision that was reported.",
+		"endpoint", "namespace", "decision")
+	configReloads = newCounterVec("ipsa_config_reloads_total",
+		"Config reloads after a change of the config file, by result.",
+		"result")
+	configReloadSuccessful = newGaugeVec("ipsa_config_last_reload_successful",
+		"Whether the last config reload succeeded (1) or failed (0).")
+	configReloadTimestamp = newGaugeVec("ipsa_config_last_reload_timestamp_seconds",
+		"Time of the last config reload attempt, by result.",
+		"result")
+	certReloads = newCounterVec("ipsa_tls_certificate_reloads_total",
+		"TLS key pair loads after a change of the files, by result.",
+		"result")
+	certExpiry = newGaugeVec("ipsa_tls_certificate_expiry_timestamp_seconds",
+		"Time the serving certificate expires.")
+	captureDrops = newCounterVec("ipsa_captures_dropped_total",
+		"Captured requests that were not written, as the queue of the capture writer was full.")
+
+	metrics = metricsRegistry{
+		admissionRequests,
+		admissionDuration,
+		secretsRemoved,
+		secretsAdded,
+		ruleHits,
+		reportOnlyDecisions,
+		configReloads,
+		configReloadSuccessful,
+		configReloadTimestamp,
+		certReloads,
+		certExpiry,
+		captureDrops,
+	}
+)
+
+// observeAdmission records a handled webhook request, along with the secrets it changed and the rules that matched.
+// Requests that could not be parsed have no operation and namespace.
+func observeAdmission(endpoint string, outcome admissionOutcome, duration time.Duration) {
+	var operation, namespace string
+	if outcome.request != nil {
+		operation = string(outcome.request.Operation)
+		namespace = outcome.request.Namespace
+	}
+
+	result := outcomeError
+	if outcome.handled {
+		result = outcomeDenied
+		if outcome.allowed {
+			result = outcomeAllowed
+		}
+	}
+
+	admissionRequests.add(1, endpoint, operation, namespace, result)
+	admissionDuration.observe(duration.Seconds(), endpoint)
+
+	for _, rule := range outcome.result.matchedRules {
+		ruleHits.add(1, rule)
+	}
+
+	// Secrets are not changed in report-only mode
+	if outcome.result.reportOnly {
+		reportOnlyDecisions.add(1, endpoint, namespace, outcome.result.reportedDecision())
+		return
+	}
+	if removed := len(outcome.result.removedSecrets); removed > 0 {
+		secretsRemoved.add(float64(removed), namespace)
+	}
+	if added := len(outcome.result.addedSecrets); added > 0 {
+		secretsAdded.add(float64(added), namespace)
+	}
+}
+
+// observeConfigReload records the result of a config reload.
+func observeConfigReload(err error) {
+	result, successful := reloadSuccess, 1.0
+	if err != nil {
+		result, successful = reloadFailure, 0
+	}
+	configReloads.add(1, result)
+	configReloadSuccessful.set(successful)
+	configReloadTimestamp.set(float64(time.Now().Unix()), result)
+}
+
+// observeCertReload records the result of loading the TLS key pair and the expiry of the certificate that is served.
+func observeCertReload(err error, notAfter time.Time) {
+	if err != nil {
+		certReloads.add(1, reloadFailure)
+		return
+	}
+	certReloads.add(1, reloadSuccess)
+	certExpiry.set(float64(notAfter.Unix()))
+}
+
+// metricsMux serves the metrics in the Prometheus text format.
+func metricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	return mux
+}
+
+// metric is a family of samples that can be written in the Prometheus text format.
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+// metricsRegistry is the list of metrics exposed by the webhook.
+type metricsRegistry []metric
+
+func (m metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, metric := range m {
+		metric.write(&buf)
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logger.Errorf("Could not write metrics: %v", err)
+	}
+}
+
+// metricFamily holds the name and labels shared by all samples of a metric, keyed by their label values.
+type metricFamily struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+// key returns the map key of a set of label values, after checking that all labels are given.
+func (f *metricFamily) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := f.values[key]; !ok {
+		f.values[key] = values
+	}
+	return key
+}
+
+// sortedKeys returns the keys of all samples in a stable order.
+func (f *metricFamily) sortedKeys() []string {
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *metricFamily) writeHeader(buf *bytes.Buffer, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, kind)
+}
+
+// writeSample writes one sample line, with extra label pairs appended to the label values of the sample.
+func (f *metricFamily) writeSample(buf *bytes.Buffer, name string, values []string, extra []string, value float64) {
+	buf.WriteString(name)
+
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, label := range f.labels {
+		pairs = append(pairs, label+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabelValue(extra[i+1])+`"`)
+	}
+	if len(pairs) > 0 {
+		buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	buf.WriteString(" " + formatFloat(value) + "\n")
+}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	metricFamily
+	counts map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{
+		metricFamily: metricFamily{name: name, help: help, labels: labels, values: map[string][]string{}},
+		counts:       map[string]float64{},
+	}
+}
+
+func (c *counterVec) add(value float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[c.key(labelValues)] += value
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(buf, "counter")
+	for _, key := range c.sortedKeys() {
+		c.writeSample(buf, c.name, c.values[key], nil, c.counts[key])
+	}
+}
+
+// gaugeVec is a gauge with labels.
+type gaugeVec struct {
+	metricFamily
+	gauges map[string]float64
+}
+
+func newGaugeVec(name string, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{
+		metricFamily: metricFamily{name: name, help: help, labels: labels, values: map[string][]string{}},
+		gauges:       map[string]float64{},
+	}
+}
+
+func (g *gaugeVec) set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.gauges[g.key(labelValues)] = value
+}
+
+func (g *gaugeVec) write(buf *bytes.Buffer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(buf, "gauge")
+	for _, key := range g.sortedKeys() {
+		g.writeSample(buf, g.name, g.values[key], nil, g.gauges[key])
+	}
+}
+
+// histogramVec is a histogram with labels. Bucket counts are stored per bucket and made cumulative when written.
+type histogramVec struct {
+	metricFamily
+	buckets []float64
+	samples map[string]*histogramSample
+}
+
+type histogramSample struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		metricFamily: metricFamily{name: name, help: help, labels: labels, values: map[string][]string{}},
+		buckets:      buckets,
+		samples:      map[string]*histogramSample{},
+	}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := h.key(labelValues)
+	sample, ok := h.samples[key]
+	if !ok {
+		sample = &histogramSample{counts: make([]uint64, len(h.buckets))}
+		h.samples[key] = sample
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		sample.counts[i]++
+	}
+	sample.count++
+	sample.sum += value
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(buf, "histogram")
+	for _, key := range h.sortedKeys() {
+		values, sample := h.values[key], h.samples[key]
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += sample.counts[i]
+			h.writeSample(buf, h.name+"_bucket", values, []string{"le", formatFloat(bound)}, float64(cumulative))
+		}
+		h.writeSample(buf, h.name+"_bucket", values, []string{"le", "+Inf"}, float64(sample.count))
+		h.writeSample(buf, h.name+"_sum", values, nil, sample.sum)
+		h.writeSample(buf, h.name+"_count", values, nil, float64(sample.count))
+	}
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
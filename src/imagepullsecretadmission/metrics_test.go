@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Returns the current value of a counter sample, 0 if it was never incremented.
+func counterValue(c *counterVec, labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[strings.Join(labelValues, "\xff")]
+}
+
+func TestMetricsExposition(t *testing.T) {
+	requests := newCounterVec("test_requests_total", "Requests.", "path", "code")
+	requests.add(1, "/b", "200")
+	requests.add(2, "/a", "500")
+	requests.add(1, "/b", "200")
+
+	reload := newGaugeVec("test_reload_successful", "Reload result.")
+	reload.set(1)
+
+	latency := newHistogramVec("test_duration_seconds", "Latency.", []float64{0.1, 1}, "path")
+	latency.observe(0.05, "/a")
+	latency.observe(0.5, "/a")
+	latency.observe(3, "/a")
+
+	escaped := newCounterVec("test_escaped_total", "Escaping.", "value")
+	escaped.add(1, "a\"b\\c\nd")
+
+	recorder := httptest.NewRecorder()
+	metricsRegistry{requests, reload, latency, escaped}.ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	want := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{path="/a",code="500"} 2
+test_requests_total{path="/b",code="200"} 2
+# HELP test_reload_successful Reload result.
+# TYPE test_reload_successful gauge
+test_reload_successful 1
+# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{path="/a",le="0.1"} 1
+test_duration_seconds_bucket{path="/a",le="1"} 2
+test_duration_seconds_bucket{path="/a",le="+Inf"} 3
+test_duration_seconds_sum{path="/a"} 3.55
+test_duration_seconds_count{path="/a"} 3
+# HELP test_escaped_total Escaping.
+# TYPE test_escaped_total counter
+test_escaped_total{value="a\"b\\c\nd"} 1
+`
+	if body := recorder.Body.String(); body != want {
+		t.Errorf("Result: Wanted\n%s\ngot\n%s", want, body)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != metricsContentType {
+		t.Errorf("Content-Type: Wanted %s, got %s", metricsContentType, contentType)
+	}
+}
+
+func TestAdmissionMetrics(t *testing.T) {
+	const namespace = "metrics-test"
+	const rule = `imagePullSecretRules[".*"][".*"]`
+
+	allowedBefore := counterValue(admissionRequests, "/mutate", "CREATE", namespace, outcomeAllowed)
+	errorsBefore := counterValue(admissionRequests, "/mutate", "", "", outcomeError)
+	addedBefore := counterValue(secretsAdded, namespace)
+	hitsBefore := counterValue(ruleHits, rule)
+
+	request := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(podReviewBody(admissionV1, namespace)))
+	request.Header.Add("Content-Type", jsonContentType)
+	if recorder := makeRequest(request, defaultConfig); recorder.Code != http.StatusOK {
+		t.Fatalf("Status: Wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader("{}"))
+	request.Header.Add("Content-Type", "text/plain")
+	makeRequest(request, defaultConfig)
+
+	if diff := counterValue(admissionRequests, "/mutate", "CREATE", namespace, outcomeAllowed) - allowedBefore; diff != 1 {
+		t.Errorf("Allowed requests: Wanted 1, got %v", diff)
+	}
+	if diff := counterValue(admissionRequests, "/mutate", "", "", outcomeError) - errorsBefore; diff != 1 {
+		t.Errorf("Failed requests: Wanted 1, got %v", diff)
+	}
+	if diff := counterValue(secretsAdded, namespace) - addedBefore; diff != 1 {
+		t.Errorf("Added secrets: Wanted 1, got %v", diff)
+	}
+	if diff := counterValue(ruleHits, rule) - hitsBefore; diff != 1 {
+		t.Errorf("Rule hits: Wanted 1, got %v", diff)
+	}
+
+	recorder := httptest.NewRecorder()
+	metricsMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `ipsa_admission_request_duration_seconds_count{endpoint="/mutate"}`) {
+		t.Errorf("Result: Wanted latency histogram of /mutate, got\n%s", recorder.Body.String())
+	}
+}
+
+func TestConfigReloadMetrics(t *testing.T) {
+	failuresBefore := counterValue(configReloads, reloadFailure)
+
+	observeConfigReload(errors.New("test error"))
+	if diff := counterValue(configReloads, reloadFailure) - failuresBefore; diff != 1 {
+		t.Errorf("Failed reloads: Wanted 1, got %v", diff)
+	}
+	if value := configReloadSuccessful.gauges[""]; value != 0 {
+		t.Errorf("Failed reload: Wanted 0, got %v", value)
+	}
+
+	observeConfigReload(nil)
+	if value := configReloadSuccessful.gauges[""]; value != 1 {
+		t.Errorf("Successful reload: Wanted 1, got %v", value)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+const (
+	// Pod annotation that asks the webhook to keep the user-provided image pull secrets.
+	preserveSecretsAnnotation = `kubetils.io/preserve-image-pull-secrets`
+
+	serviceAccountUserPrefix = `system:serviceaccount:`
+)
+
+// PreserveOverride lists who may set the preserveSecretsAnnotation on a pod.
+// ServiceAccounts are given as "namespace/name".
+type PreserveOverride struct {
+	Users           []string `yaml:"users,omitempty"`
+	Groups          []string `yaml:"groups,omitempty"`
+	ServiceAccounts []string `yaml:"serviceAccounts,omitempty"`
+}
+
+// Checks whether the pod asks to keep its user-provided image pull secrets.
+// The annotation is only honoured if the requesting user is on the allowlist
+// in the config, everybody else gets the request rejected. Every honoured use
+// is logged as a break-glass event.
+// The annotation is rejected on the pod templates of workloads, as their pods
+// are created by a controller, which is not on the allowlist.
+func preserveUserSecrets(req *admissionRequest, config Config, pod corev1.Pod) (bool, error) {
+	if pod.Annotations[preserveSecretsAnnotation] != "true" {
+		return false, nil
+	}
+
+	if req.Resource != podResource {
+		return false, fmt.Errorf("the annotation %s is not allowed on the pod templates of %s, as their pods "+
+			"are created by a controller; use a user secret policy for the namespace instead",
+			preserveSecretsAnnotation, req.Resource.Resource)
+	}
+
+	user := req.UserInfo.Username
+	if !config.PreserveOverride.allows(user, req.UserInfo.Groups) {
+		return false, fmt.Errorf("user %q is not allowed to set the annotation %s, remove the annotation to "+
+			"have the managed image pull secrets applied", user, preserveSecretsAnnotation)
+	}
+
+	requestLogger(req).log(levelWarn, logFields{"breakGlass": true},
+		"BREAK-GLASS: user %q preserved image pull secrets %v of pod %s in namespace %s (request %s)",
+		user, secretNames(pod.Spec.ImagePullSecrets), podName(pod), req.Namespace, req.UID)
+	return true, nil
+}
+
+// Checks the user and its groups against the allowlist.
+func (o PreserveOverride) allows(user string, groups []string) bool {
+	for _, allowed := range o.Users {
+		if allowed == user {
+			return true
+		}
+	}
+
+	for _, allowed := range o.Groups {
+		for _, group := range groups {
+			if allowed == group {
+				return true
+			}
+		}
+	}
+
+	if strings.HasPrefix(user, serviceAccountUserPrefix) {
+		serviceAccount := strings.Replace(strings.TrimPrefix(user, serviceAccountUserPrefix), ":", "/", 1)
+		for _, allowed := range o.ServiceAccounts {
+			if allowed == serviceAccount {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Checks that all service accounts are given as namespace/name.
+func (o PreserveOverride) validate(path string, errs *configErrors) {
+	for i, serviceAccount := range o.ServiceAccounts {
+		parts := strings.Split(serviceAccount, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs.add(fmt.Sprintf("%s.serviceAccounts[%d]", path, i),
+				"invalid service account %q, must be namespace/name", serviceAccount)
+		}
+	}
+}
+
+// Returns the names of the referenced secrets.
+func secretNames(refs []corev1.LocalObjectReference) []string {
+	var names []string
+	for _, ref := range refs {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+// Returns the name of the pod, or its generateName if the name is not set yet.
+func podName(pod corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
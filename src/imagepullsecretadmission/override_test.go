@@ -0,0 +1,84 @@
+package main
+
+import (
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+var overrideConfig Config = mustCompile(Config{
+	ImagePullSecretRules: defaultConfig.ImagePullSecretRules,
+	PreserveOverride: PreserveOverride{
+		Users:           []string{"admin@example.com"},
+		Groups:          []string{"platform-oncall"},
+		ServiceAccounts: []string{"ci/deployer"},
+	},
+})
+
+// Builds an AdmissionRequest by the given user for a pod carrying the
+// preserve annotation and a user-provided image pull secret.
+func preservePodRequest(t *testing.T, user string, groups ...string) *admissionRequest {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "testns",
+			Annotations: map[string]string{preserveSecretsAnnotation: "true"},
+		},
+		Spec: corev1.PodSpec{
+			Containers:       []corev1.Container{{Image: "test"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "my-creds"}},
+		},
+	}
+
+	req := podRequest(t, pod)
+	req.UserInfo = authenticationv1.UserInfo{Username: user, Groups: groups}
+	return req
+}
+
+func TestPreserveAnnotationAllowed(t *testing.T) {
+	requests := map[string]*admissionRequest{
+		"user":            preservePodRequest(t, "admin@example.com"),
+		"group":           preservePodRequest(t, "someone@example.com", "system:authenticated", "platform-oncall"),
+		"service account": preservePodRequest(t, "system:serviceaccount:ci:deployer"),
+	}
+
+	for name, request := range requests {
+		request := request
+		t.Run(name, func(t *testing.T) {
+			res, err := manageImagePullSecrets(request, overrideConfig)
+			if err != nil {
+				t.Errorf("Error: Wanted nil, got %v", err)
+			}
+			for _, op := range res.patches {
+				if op.Op == "remove" {
+					t.Errorf("Result: Wanted user secrets to be kept, got %v", res.patches)
+				}
+			}
+			if len(res.patches) != 1 || patchValue(t, res.patches[0]) != `{"name":"testSecret"}` {
+				t.Errorf("Result: Wanted testSecret to be appended, got %v", res.patches)
+			}
+		})
+	}
+}
+
+func TestPreserveAnnotationRejected(t *testing.T) {
+	tests := map[string]struct {
+		request *admissionRequest
+		config  Config
+	}{
+		"user":                  {preservePodRequest(t, "someone@example.com", "system:authenticated"), overrideConfig},
+		"other service account": {preservePodRequest(t, "system:serviceaccount:ci:builder"), overrideConfig},
+		"no allowlist":          {preservePodRequest(t, "admin@example.com"), defaultConfig},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			_, err := manageImagePullSecrets(test.request, test.config)
+			if err == nil || !strings.Contains(err.Error(), "is not allowed to set the annotation") {
+				t.Errorf("Error: Wanted rejection of the annotation, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Applies the JSON patch to the JSON document the same way the API server
+// does, to show the object the webhook produces. Only the add, remove and
+// replace operations are supported, as the webhook uses no others.
+func applyPatch(doc []byte, ops []patchOperation) ([]byte, error) {
+	var root interface{}
+	if err := json.Unmarshal(doc, &root); err != nil {
+		return nil, fmt.Errorf("could not deserialize document: %v", err)
+	}
+
+	for _, op := range ops {
+		// Round-trip the value, so that it has the same types as the document
+		var value interface{}
+		if op.Op != "remove" {
+			encoded, err := json.Marshal(op.Value)
+			if err != nil {
+				return nil, fmt.Errorf("could not marshal value of %s %s: %v", op.Op, op.Path, err)
+			}
+			if err := json.Unmarshal(encoded, &value); err != nil {
+				return nil, fmt.Errorf("could not deserialize value of %s %s: %v", op.Op, op.Path, err)
+			}
+		}
+
+		switch op.Op {
+		case "add", "remove", "replace":
+		default:
+			return nil, fmt.Errorf("unsupported patch operation %s", op.Op)
+		}
+		if op.Path == "" {
+			return nil, fmt.Errorf("cannot %s the whole document", op.Op)
+		}
+
+		var err error
+		if root, err = applyOperation(root, splitPointer(op.Path), op, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(root)
+}
+
+// Splits a JSON pointer into its unescaped reference tokens.
+func splitPointer(path string) []string {
+	tokens := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens
+}
+
+// Applies the operation at the remaining tokens of its path below node, and
+// returns the changed node.
+func applyOperation(node interface{}, tokens []string, op patchOperation, value interface{}) (interface{}, error) {
+	token, last := tokens[0], len(tokens) == 1
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[token]
+		if !last {
+			if !ok {
+				return nil, fmt.Errorf("%s %s: path does not exist", op.Op, op.Path)
+			}
+			child, err := applyOperation(child, tokens[1:], op, value)
+			n[token] = child
+			return n, err
+		}
+
+		switch {
+		case op.Op == "add":
+			n[token] = value
+		case !ok:
+			return nil, fmt.Errorf("%s %s: path does not exist", op.Op, op.Path)
+		case op.Op == "replace":
+			n[token] = value
+		default:
+			delete(n, token)
+		}
+		return n, nil
+
+	case []interface{}:
+		if last && op.Op == "add" && token == "-" {
+			return append(n, value), nil
+		}
+
+		index, err := strconv.Atoi(token)
+		size := len(n)
+		if last && op.Op == "add" {
+			size++
+		}
+		if err != nil || index < 0 || index >= size {
+			return nil, fmt.Errorf("%s %s: invalid array index %s", op.Op, op.Path, token)
+		}
+
+		if !last {
+			child, err := applyOperation(n[index], tokens[1:], op, value)
+			n[index] = child
+			return n, err
+		}
+
+		switch op.Op {
+		case "add":
+			n = append(n, nil)
+			copy(n[index+1:], n[index:])
+			n[index] = value
+		case "replace":
+			n[index] = value
+		default:
+			n = append(n[:index], n[index+1:]...)
+		}
+		return n, nil
+
+	default:
+		return nil, fmt.Errorf("%s %s: path does not exist", op.Op, op.Path)
+	}
+}
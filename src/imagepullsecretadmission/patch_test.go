@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestApplyPatch(t *testing.T) {
+	const doc = `{"spec":{"imagePullSecrets":[{"name":"a"},{"name":"b"}]}}`
+
+	tests := map[string]struct {
+		ops  []patchOperation
+		want string
+	}{
+		"append": {
+			ops:  []patchOperation{{Op: "add", Path: "/spec/imagePullSecrets/-", Value: map[string]string{"name": "c"}}},
+			want: `{"spec":{"imagePullSecrets":[{"name":"a"},{"name":"b"},{"name":"c"}]}}`,
+		},
+		"insert": {
+			ops:  []patchOperation{{Op: "add", Path: "/spec/imagePullSecrets/0", Value: map[string]string{"name": "c"}}},
+			want: `{"spec":{"imagePullSecrets":[{"name":"c"},{"name":"a"},{"name":"b"}]}}`,
+		},
+		"remove element": {
+			ops:  []patchOperation{{Op: "remove", Path: "/spec/imagePullSecrets/0"}},
+			want: `{"spec":{"imagePullSecrets":[{"name":"b"}]}}`,
+		},
+		"remove and recreate": {
+			ops: []patchOperation{
+				{Op: "remove", Path: "/spec/imagePullSecrets"},
+				{Op: "add", Path: "/spec/imagePullSecrets", Value: []string{}},
+				{Op: "add", Path: "/spec/imagePullSecrets/-", Value: map[string]string{"name": "c"}},
+			},
+			want: `{"spec":{"imagePullSecrets":[{"name":"c"}]}}`,
+		},
+		"replace": {
+			ops:  []patchOperation{{Op: "replace", Path: "/spec/imagePullSecrets/1/name", Value: "c"}},
+			want: `{"spec":{"imagePullSecrets":[{"name":"a"},{"name":"c"}]}}`,
+		},
+		"escaped key": {
+			ops:  []patchOperation{{Op: "add", Path: "/spec/a~1b~0c", Value: true}},
+			want: `{"spec":{"a/b~c":true,"imagePullSecrets":[{"name":"a"},{"name":"b"}]}}`,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			patched, err := applyPatch([]byte(doc), test.ops)
+			if err != nil {
+				t.Fatalf("Error: Wanted nil, got %v", err)
+			}
+			if string(patched) != test.want {
+				t.Errorf("Result: Wanted %s, got %s", test.want, patched)
+			}
+		})
+	}
+}
+
+func TestApplyPatchInvalid(t *testing.T) {
+	const doc = `{"spec":{"imagePullSecrets":[{"name":"a"}]}}`
+
+	tests := map[string]patchOperation{
+		"missing parent":     {Op: "add", Path: "/spec/template/spec/imagePullSecrets", Value: []string{}},
+		"remove missing":     {Op: "remove", Path: "/spec/containers"},
+		"replace missing":    {Op: "replace", Path: "/spec/containers", Value: []string{}},
+		"index out of range": {Op: "remove", Path: "/spec/imagePullSecrets/1"},
+		"invalid index":      {Op: "add", Path: "/spec/imagePullSecrets/first", Value: "a"},
+		"unsupported op":     {Op: "move", Path: "/spec/imagePullSecrets"},
+	}
+
+	for name, op := range tests {
+		op := op
+		t.Run(name, func(t *testing.T) {
+			if _, err := applyPatch([]byte(doc), []patchOperation{op}); err == nil {
+				t.Errorf("Error: Wanted error, got nil")
+			}
+		})
+	}
+}
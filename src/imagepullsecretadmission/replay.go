@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// runReplay feeds the AdmissionReviews captured in a directory through the admission controllers with a candidate
+// config, and reports every request whose allow/deny decision or patch differs from the captured response. It fails if
+// any request changed, so it can guard config changes in CI.
+func runReplay(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "candidate config file to replay the requests with")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: replay [flags] capture-dir")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("replay takes exactly one capture directory")
+	}
+
+	config, _, err := loadConfigFile(*configPath)
+	if err != nil {
+		return fmt.Errorf("cannot load config file %s: %v", *configPath, err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(flags.Arg(0), "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	var out bytes.Buffer
+	changed := 0
+	for _, file := range files {
+		diff, err := replayFile(file, config)
+		if err != nil {
+			return err
+		}
+		if diff != "" {
+			changed++
+			fmt.Fprintf(&out, "%s: %s", filepath.Base(file), diff)
+		}
+	}
+	fmt.Fprintf(&out, "Replayed %d requests, %d changed\n", len(files), changed)
+
+	if _, err := stdout.Write(out.Bytes()); err != nil {
+		return err
+	}
+	if changed > 0 {
+		return fmt.Errorf("%d of %d replayed requests changed", changed, len(files))
+	}
+	return nil
+}
+
+// Replays a captured review and describes how the response changed, or returns an empty string if it did not.
+func replayFile(file string, config Config) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	var captured capturedReview
+	if err := json.Unmarshal(content, &captured); err != nil {
+		return "", fmt.Errorf("could not deserialize %s: %v", file, err)
+	}
+	var review admissionReview
+	if err := json.Unmarshal(captured.Review, &review); err != nil || review.Request == nil {
+		return "", fmt.Errorf("%s has no valid request: %v", file, err)
+	}
+	admit, ok := admitFuncs[captured.Endpoint]
+	if !ok {
+		return "", fmt.Errorf("%s was captured on unknown endpoint %s", file, captured.Endpoint)
+	}
+
+	var before admissionReview
+	if err := json.Unmarshal(captured.Response, &before); err != nil || before.Response == nil {
+		return "", fmt.Errorf("%s has no valid response: %v", file, err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, captured.Endpoint, bytes.NewReader(captured.Review))
+	r.Header.Set("Content-Type", jsonContentType)
+	response, _, err := doServeAdmitFunc(httptest.NewRecorder(), r, config, admit)
+	if err != nil {
+		return "", fmt.Errorf("could not replay %s: %v", file, err)
+	}
+
+	var after admissionReview
+	if err := json.Unmarshal(response, &after); err != nil {
+		return "", err
+	}
+
+	return describeResponseChange(captured.Endpoint, review.Request, before.Response, after.Response)
+}
+
+// Describes the changes of the decision and the patch between two responses to the request.
+func describeResponseChange(endpoint string, req *admissionRequest, before *admissionResponse,
+	after *admissionResponse) (string, error) {
+	var diff bytes.Buffer
+
+	if before.Allowed != after.Allowed {
+		fmt.Fprintf(&diff, "  allowed: %t -> %t%s\n", before.Allowed, after.Allowed, denialMessage(after))
+	}
+
+	samePatch, err := equalJSON(before.Patch, after.Patch)
+	if err != nil {
+		return "", err
+	}
+	if !samePatch {
+		fmt.Fprintf(&diff, "  patch:\n    - %s\n    + %s\n", patchOrNone(before.Patch), patchOrNone(after.Patch))
+	}
+
+	if diff.Len() == 0 {
+		return "", nil
+	}
+
+	name, generateName := requestObjectName(req)
+	if name == "" {
+		name = generateName
+	}
+	return fmt.Sprintf("%s %s %s %s/%s (uid %s)\n%s", endpoint, req.Operation, req.Resource.Resource,
+		req.Namespace, name, req.UID, diff.String()), nil
+}
+
+func denialMessage(response *admissionResponse) string {
+	if response.Allowed || response.Result == nil {
+		return ""
+	}
+	return ": " + response.Result.Message
+}
+
+func patchOrNone(patch []byte) string {
+	if len(patch) == 0 {
+		return "none"
+	}
+	return string(patch)
+}
+
+// Compares two JSON documents regardless of their formatting. Empty documents are equal.
+func equalJSON(a []byte, b []byte) (bool, error) {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b), nil
+	}
+
+	var decodedA, decodedB interface{}
+	if err := json.Unmarshal(a, &decodedA); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, &decodedB); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(decodedA, decodedB), nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+const (
+	// Audit annotations of requests that were only reported
+	auditReportOnly = "report-only"
+	auditWouldPatch = "would-patch"
+	auditWouldDeny  = "would-deny"
+
+	// Decisions that were only reported, for the metrics
+	decisionPatch = "patch"
+	decisionDeny  = "deny"
+	decisionNone  = "none"
+)
+
+// ReportOnly lists where the image pull secret webhook only reports what it would do,
+// either everywhere if Enabled is set, or in the namespaces matching any of the Namespaces regexes.
+type ReportOnly struct {
+	Enabled    bool     `yaml:"enabled,omitempty"`
+	Namespaces []string `yaml:"namespaces,omitempty"`
+
+	namespaces []*regexp.Regexp
+}
+
+// Checks whether requests in the namespace are only reported.
+func (r ReportOnly) applies(namespace string) bool {
+	return r.Enabled || matchesAny(r.namespaces, namespace)
+}
+
+// Compiles the namespace regexes.
+func (r ReportOnly) compile(path string, errs *configErrors) ReportOnly {
+	r.namespaces = nil
+	for i, namespace := range r.Namespaces {
+		r.namespaces = append(r.namespaces, errs.regexp(fmt.Sprintf("%s.namespaces[%d]", path, i), namespace))
+	}
+	return r
+}
+
+// reportOnly wraps an admitFunc, so that requests in report-only namespaces get the full decision computed but are
+// admitted unchanged. The decision is kept in the result for logs and metrics, and added to the audit annotations.
+// Warnings are dropped, as they would tell the user about changes that did not happen.
+func reportOnly(admit admitFunc) admitFunc {
+	return func(req *admissionRequest, config Config) (admissionResult, error) {
+		result, err := admit(req, config)
+		if !config.ReportOnly.applies(req.Namespace) {
+			return result, err
+		}
+
+		result.reportOnly = true
+		result.wouldPatch = result.patches
+		result.wouldDeny = err
+		result.patches = nil
+		result.warnings = nil
+
+		if result.auditAnnotations == nil {
+			result.auditAnnotations = map[string]string{}
+		}
+		result.auditAnnotations[auditReportOnly] = "true"
+		if err != nil {
+			result.auditAnnotations[auditWouldDeny] = err.Error()
+		} else if len(result.wouldPatch) > 0 {
+			if patch, err := json.Marshal(result.wouldPatch); err == nil {
+				result.auditAnnotations[auditWouldPatch] = string(patch)
+			}
+		}
+
+		return result, nil
+	}
+}
+
+// reportedDecision names the decision of a report-only request.
+func (r admissionResult) reportedDecision() string {
+	switch {
+	case r.wouldDeny != nil:
+		return decisionDeny
+	case len(r.wouldPatch) > 0:
+		return decisionPatch
+	default:
+		return decisionNone
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Sends the request to /mutate as a v1 review and returns the response.
+func mutateResponse(t *testing.T, request *admissionRequest, config Config) *admissionResponse {
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBody(t, admissionV1, request)))
+	req.Header.Add("Content-Type", jsonContentType)
+
+	recorder := makeRequest(req, config)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Status: Wanted %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	var review admissionReview
+	if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil || review.Response == nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	return review.Response
+}
+
+func TestReportOnlyPatch(t *testing.T) {
+	configs := map[string]Config{
+		"global": mustCompile(Config{
+			ImagePullSecretRules: defaultConfig.ImagePullSecretRules,
+			ReportOnly:           ReportOnly{Enabled: true},
+		}),
+		"namespace": mustCompile(Config{
+			ImagePullSecretRules: defaultConfig.ImagePullSecretRules,
+			ReportOnly:           ReportOnly{Namespaces: []string{"^test"}},
+		}),
+	}
+
+	for name, config := range configs {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			before := counterValue(reportOnlyDecisions, "/mutate", "testns", decisionPatch)
+
+			response := mutateResponse(t, podWithSecretsRequest(t, "testns", "my-creds"), config)
+			if !response.Allowed || response.Patch != nil || response.Warnings != nil {
+				t.Errorf("Result: Wanted unchanged admission without warnings, got %+v", response)
+			}
+
+			annotations := response.AuditAnnotations
+			if annotations[auditReportOnly] != "true" || annotations[auditRemovedSecrets] != `["my-creds"]` {
+				t.Errorf("Audit annotations: Wanted report of removed secrets, got %v", annotations)
+			}
+			var patch []patchOperation
+			if err := json.Unmarshal([]byte(annotations[auditWouldPatch]), &patch); err != nil || len(patch) != 1 {
+				t.Errorf("Audit annotations: Wanted the patch that would have been applied, got %v", annotations)
+			}
+
+			if diff := counterValue(reportOnlyDecisions, "/mutate", "testns", decisionPatch) - before; diff != 1 {
+				t.Errorf("Reported patches: Wanted 1, got %v", diff)
+			}
+		})
+	}
+}
+
+func TestReportOnlyDeny(t *testing.T) {
+	config := mustCompile(Config{
+		ImagePullSecretRules: defaultConfig.ImagePullSecretRules,
+		ReportOnly:           ReportOnly{Namespaces: []string{"^testns$"}},
+	})
+
+	response := mutateResponse(t, preservePodRequest(t, "alice"), config)
+	if !response.Allowed || response.Patch != nil {
+		t.Errorf("Result: Wanted unchanged admission, got %+v", response)
+	}
+	if response.AuditAnnotations[auditWouldDeny] == "" {
+		t.Errorf("Audit annotations: Wanted the denial that would have been returned, got %v", response.AuditAnnotations)
+	}
+}
+
+func TestReportOnlyOtherNamespace(t *testing.T) {
+	config := mustCompile(Config{
+		ImagePullSecretRules: defaultConfig.ImagePullSecretRules,
+		ReportOnly:           ReportOnly{Namespaces: []string{"^staging$"}},
+	})
+
+	response := mutateResponse(t, podWithSecretsRequest(t, "testns", "my-creds"), config)
+	if response.Patch == nil || response.AuditAnnotations[auditReportOnly] != "" {
+		t.Errorf("Result: Wanted the patch to be applied outside report-only namespaces, got %+v", response)
+	}
+}
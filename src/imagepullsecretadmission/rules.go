@@ -0,0 +1,252 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+const (
+	// Later rules are still evaluated for an image this rule matched.
+	evaluationAccumulate = `accumulate`
+	// No further rules are evaluated for an image this rule matched.
+	evaluationFirstMatch = `firstMatch`
+)
+
+// secretList is a list of secret names that may also be written as a single
+// string in YAML.
+type secretList []string
+
+func (l *secretList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var secret string
+	if err := unmarshal(&secret); err == nil {
+		*l = secretList{secret}
+		return nil
+	}
+
+	var secrets []string
+	if err := unmarshal(&secrets); err != nil {
+		return err
+	}
+	*l = secrets
+	return nil
+}
+
+// ImagePullSecretRule adds Secrets and the secrets of the SecretSets to pods
+// in a namespace matching any of the Namespaces regexes, for every image
+// matching any of the Images matchers.
+// Rules are evaluated in order, Evaluation decides whether the rules after a
+// matching rule are still evaluated for the image (evaluationAccumulate, the
+// default) or not (evaluationFirstMatch).
+type ImagePullSecretRule struct {
+	Name       string         `yaml:"name,omitempty"`
+	Namespaces []string       `yaml:"namespaces"`
+	Images     []ImageMatcher `yaml:"images"`
+	Secrets    []string       `yaml:"secrets,omitempty"`
+	SecretSets []string       `yaml:"secretSets,omitempty"`
+	Evaluation string         `yaml:"evaluation,omitempty"`
+}
+
+// secretRule is a compiled ImagePullSecretRule, or a compiled entry of the
+// legacy ImagePullSecretRules map.
+type secretRule struct {
+	id         string
+	namespaces []*regexp.Regexp
+	images     []imageMatcher
+	secrets    []string
+	firstMatch bool
+}
+
+// Compiles the ordered rules followed by the legacy rule map. The legacy map is
+// converted into accumulating rules sorted by namespace and image regex, so
+// that its evaluation order does not depend on map iteration.
+func compileSecretRules(c Config, errs *configErrors) []secretRule {
+	var rules []secretRule
+	ids := map[string]struct{}{}
+
+	for i, rule := range c.Rules {
+		path := fmt.Sprintf("rules[%d]", i)
+
+		compiled := secretRule{id: rule.Name}
+		if compiled.id == "" {
+			compiled.id = path
+		}
+		if _, ok := ids[compiled.id]; ok {
+			errs.add(path+".name", "duplicate rule name %q", rule.Name)
+		}
+		ids[compiled.id] = struct{}{}
+
+		if len(rule.Namespaces) == 0 {
+			errs.add(path+".namespaces", "at least one namespace regex is required")
+		}
+		for j, namespaceRegex := range rule.Namespaces {
+			compiled.namespaces = append(compiled.namespaces,
+				errs.regexp(fmt.Sprintf("%s.namespaces[%d]", path, j), namespaceRegex))
+		}
+
+		if len(rule.Images) == 0 {
+			errs.add(path+".images", "at least one image matcher is required")
+		}
+		for j, image := range rule.Images {
+			compiled.images = append(compiled.images, image.compile(fmt.Sprintf("%s.images[%d]", path, j), errs))
+		}
+
+		if len(rule.Secrets) == 0 && len(rule.SecretSets) == 0 {
+			errs.add(path, "at least one secret or secret set is required")
+		}
+		checkSecretNames(path+".secrets", rule.Secrets, errs)
+		compiled.secrets = rule.Secrets
+		for j, set := range rule.SecretSets {
+			secrets, ok := c.SecretSets[set]
+			if !ok {
+				errs.add(fmt.Sprintf("%s.secretSets[%d]", path, j), "undefined secret set %q", set)
+			}
+			compiled.secrets = append(compiled.secrets, secrets...)
+		}
+		compiled.secrets = uniqueSecrets(compiled.secrets)
+
+		switch rule.Evaluation {
+		case "", evaluationAccumulate:
+		case evaluationFirstMatch:
+			compiled.firstMatch = true
+		default:
+			errs.add(path+".evaluation", "invalid evaluation %q, must be %s or %s",
+				rule.Evaluation, evaluationAccumulate, evaluationFirstMatch)
+		}
+
+		rules = append(rules, compiled)
+	}
+
+	for _, namespaceRegex := range sortedRuleKeys(c.ImagePullSecretRules) {
+		path := fmt.Sprintf("imagePullSecretRules[%q]", namespaceRegex)
+		namespace := errs.regexp(path, namespaceRegex)
+
+		imageMap := c.ImagePullSecretRules[namespaceRegex]
+		for _, imageRegex := range sortedSecretKeys(imageMap) {
+			imagePath := fmt.Sprintf("%s[%q]", path, imageRegex)
+			if len(imageMap[imageRegex]) == 0 {
+				errs.add(imagePath, "at least one secret is required")
+			}
+			checkSecretNames(imagePath, imageMap[imageRegex], errs)
+			rules = append(rules, secretRule{
+				id:         imagePath,
+				namespaces: []*regexp.Regexp{namespace},
+				images:     []imageMatcher{ImageMatcher{Regex: imageRegex}.compile(imagePath, errs)},
+				secrets:    uniqueSecrets(imageMap[imageRegex]),
+			})
+		}
+	}
+
+	return rules
+}
+
+// Checks that the secret sets are not empty and contain valid secret names.
+func checkSecretSets(secretSets map[string][]string, errs *configErrors) {
+	var names []string
+	for name := range secretSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := fmt.Sprintf("secretSets[%q]", name)
+		if len(secretSets[name]) == 0 {
+			errs.add(path, "at least one secret is required")
+		}
+		checkSecretNames(path, secretSets[name], errs)
+	}
+}
+
+// Reports every empty secret name.
+func checkSecretNames(path string, secrets []string, errs *configErrors) {
+	for i, secret := range secrets {
+		if secret == "" {
+			errs.add(fmt.Sprintf("%s[%d]", path, i), "secret name must not be empty")
+		}
+	}
+}
+
+// Removes duplicate secrets, keeping the first occurrence.
+func uniqueSecrets(secrets []string) []string {
+	var unique []string
+	seen := map[string]struct{}{}
+	for _, secret := range secrets {
+		if _, ok := seen[secret]; !ok {
+			seen[secret] = struct{}{}
+			unique = append(unique, secret)
+		}
+	}
+	return unique
+}
+
+// Evaluates the rules for every image in the namespace and returns the secrets
+// to add and the IDs of the rules that matched. Both are in the order of the
+// images and rules, without duplicates.
+func evaluateSecretRules(rules []secretRule, namespace string, images []string) ([]string, []string) {
+	return traceSecretRules(rules, namespace, images, nil)
+}
+
+// ruleCheck is a single check of a rule against an image. The image is only
+// matched if the namespace matched.
+type ruleCheck struct {
+	image            podImage
+	rule             secretRule
+	namespaceMatched bool
+	imageMatched     bool
+}
+
+// Same as evaluateSecretRules, but reports every check of a rule against an
+// image to trace, if it is not nil. Rules that are skipped after a firstMatch
+// rule matched are not reported.
+func traceSecretRules(rules []secretRule, namespace string, images []string,
+	trace func(ruleCheck)) ([]string, []string) {
+	var secrets, matched []string
+	seenSecrets := map[string]struct{}{}
+	seenRules := map[string]struct{}{}
+
+	for _, image := range images {
+		parsed := newPodImage(image)
+		for _, rule := range rules {
+			check := ruleCheck{image: parsed, rule: rule, namespaceMatched: matchesAny(rule.namespaces, namespace)}
+			check.imageMatched = check.namespaceMatched && matchesAnyImage(rule.images, parsed)
+			if trace != nil {
+				trace(check)
+			}
+			if !check.imageMatched {
+				continue
+			}
+
+			if _, ok := seenRules[rule.id]; !ok {
+				seenRules[rule.id] = struct{}{}
+				matched = append(matched, rule.id)
+			}
+			for _, secret := range rule.secrets {
+				if _, ok := seenSecrets[secret]; !ok {
+					seenSecrets[secret] = struct{}{}
+					secrets = append(secrets, secret)
+				}
+			}
+
+			if rule.firstMatch {
+				break
+			}
+		}
+	}
+
+	return secrets, matched
+}
+
+// Checks whether any of the regexes matches the value.
+func matchesAny(regexes []*regexp.Regexp, value string) bool {
+	for _, regex := range regexes {
+		if regex.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const orderedRulesYAML = `
+rules:
+- name: team-a-gcr
+  namespaces: ["^team-a$"]
+  images: ["^gcr.io/team-a/"]
+  secrets: ["team-a-gcr"]
+  evaluation: firstMatch
+- name: gcr
+  namespaces: ["^team-"]
+  images: ["^gcr.io/"]
+  secrets: ["gcr-secret"]
+- name: dockerhub
+  namespaces: [".*"]
+  images: [".*"]
+  secrets: ["dockerhub-default"]
+imagePullSecretRules:
+  "^team-b$":
+    "^quay.io/": "quay-secret"
+    "^gcr.io/": "legacy-gcr"
+`
+
+func TestEvaluateSecretRules(t *testing.T) {
+	config, err := parseConfig([]byte(orderedRulesYAML))
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+
+	tests := []struct {
+		namespace   string
+		images      []string
+		wantSecrets []string
+		wantRules   []string
+	}{
+		{"team-a", []string{"gcr.io/team-a/app"},
+			[]string{"team-a-gcr"}, []string{"team-a-gcr"}},
+		{"team-a", []string{"gcr.io/team-a/app", "gcr.io/shared/proxy"},
+			[]string{"team-a-gcr", "gcr-secret", "dockerhub-default"}, []string{"team-a-gcr", "gcr", "dockerhub"}},
+		{"team-b", []string{"gcr.io/team-a/app"},
+			[]string{"gcr-secret", "dockerhub-default", "legacy-gcr"},
+			[]string{"gcr", "dockerhub", `imagePullSecretRules["^team-b$"]["^gcr.io/"]`}},
+		{"other", []string{"nginx"},
+			[]string{"dockerhub-default"}, []string{"dockerhub"}},
+	}
+
+	for _, test := range tests {
+		secrets, rules := evaluateSecretRules(config.secretRules, test.namespace, test.images)
+		if !reflect.DeepEqual(secrets, test.wantSecrets) {
+			t.Errorf("%s %v: Secrets: Wanted %v, got %v", test.namespace, test.images, test.wantSecrets, secrets)
+		}
+		if !reflect.DeepEqual(rules, test.wantRules) {
+			t.Errorf("%s %v: Rules: Wanted %v, got %v", test.namespace, test.images, test.wantRules, rules)
+		}
+	}
+}
+
+// The legacy map is evaluated in sorted order, so that the patches do not
+// depend on map iteration
+func TestLegacyRulesReproducible(t *testing.T) {
+	config := mustCompile(Config{
+		ImagePullSecretRules: map[string]map[string]secretList{
+			".*":     {".*": {"c-secret"}, "^t": {"a-secret"}, "^te": {"d-secret"}},
+			"^test":  {".*": {"b-secret"}},
+			"^tests": {".*": {"e-secret"}},
+		},
+	})
+
+	want := []string{"c-secret", "a-secret", "d-secret", "b-secret"}
+	for i := 0; i < 20; i++ {
+		res, err := manageImagePullSecrets(podWithSecretsRequest(t, "testns"), config)
+		if err != nil {
+			t.Fatalf("Error: Wanted nil, got %v", err)
+		}
+
+		var secrets []string
+		var refs []struct{ Name string }
+		if err := json.Unmarshal([]byte(patchValue(t, res.patches[0])), &refs); err != nil {
+			t.Fatalf("Failed JSON unmarshal with %v", err)
+		}
+		for _, ref := range refs {
+			secrets = append(secrets, ref.Name)
+		}
+		if !reflect.DeepEqual(secrets, want) {
+			t.Fatalf("Run %d: Wanted secrets %v, got %v", i, want, secrets)
+		}
+	}
+}
+
+func TestSecretRulesInvalid(t *testing.T) {
+	const content = `
+rules:
+- name: dup
+  namespaces: ["("]
+  images: [".*"]
+  secrets: ["a"]
+- name: dup
+  namespaces: [".*"]
+  images: []
+  secrets: [""]
+  evaluation: lastMatch
+- namespaces: [".*"]
+  images: [".*"]
+`
+	want := []string{
+		`rules[0].namespaces[0]: invalid regex`,
+		`rules[1].name: duplicate rule name "dup"`,
+		`rules[1].images: at least one image matcher is required`,
+		`rules[1].secrets[0]: secret name must not be empty`,
+		`rules[1].evaluation: invalid evaluation "lastMatch"`,
+		`rules[2]: at least one secret or secret set is required`,
+	}
+
+	_, err := parseConfig([]byte(content))
+	if err == nil {
+		t.Fatal("Error: Wanted errors, got nil")
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("Error: Wanted error containing '%s', got %v", w, err)
+		}
+	}
+}
+
+const secretSetsYAML = `
+secretSets:
+  gcr-rotation: ["gcr-old", "gcr-new"]
+rules:
+- name: gcr
+  namespaces: [".*"]
+  images: ["^gcr.io/"]
+  secrets: ["gcr-old", "gcr-extra"]
+  secretSets: ["gcr-rotation"]
+imagePullSecretRules:
+  ".*":
+    "^us.gcr.io/": ["us-gcr-old", "us-gcr-new"]
+    "^eu.gcr.io/": "eu-gcr"
+`
+
+// Rules may hand out several secrets, e.g. an old and a new credential
+// during a rotation, either listed directly or through a secret set
+func TestMultipleSecretsPerRule(t *testing.T) {
+	config, err := parseConfig([]byte(secretSetsYAML))
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+
+	tests := []struct {
+		image string
+		want  []string
+	}{
+		{"gcr.io/app", []string{"gcr-old", "gcr-extra", "gcr-new"}},
+		{"us.gcr.io/app", []string{"us-gcr-old", "us-gcr-new"}},
+		{"eu.gcr.io/app", []string{"eu-gcr"}},
+	}
+
+	for _, test := range tests {
+		secrets, _ := evaluateSecretRules(config.secretRules, "testns", []string{test.image})
+		if !reflect.DeepEqual(secrets, test.want) {
+			t.Errorf("%s: Wanted %v, got %v", test.image, test.want, secrets)
+		}
+	}
+}
+
+func TestSecretSetsInvalid(t *testing.T) {
+	const content = `
+secretSets:
+  empty: []
+  broken: ["ok", ""]
+rules:
+- namespaces: [".*"]
+  images: [".*"]
+  secretSets: ["missing"]
+`
+	want := []string{
+		`secretSets["empty"]: at least one secret is required`,
+		`secretSets["broken"][1]: secret name must not be empty`,
+		`rules[0].secretSets[0]: undefined secret set "missing"`,
+	}
+
+	_, err := parseConfig([]byte(content))
+	if err == nil {
+		t.Fatal("Error: Wanted errors, got nil")
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("Error: Wanted error containing '%s', got %v", w, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// newServer returns the webhook server with the timeouts and limits of the settings, serving the key pair of certs.
+func newServer(settings Application, handler http.Handler, certs *certReloader) *http.Server {
+	return &http.Server{
+		Addr:              settings.ListenAddr,
+		Handler:           handler,
+		TLSConfig:         &tls.Config{GetCertificate: certs.GetCertificate},
+		ReadHeaderTimeout: settings.ReadTimeout,
+		ReadTimeout:       settings.ReadTimeout,
+		WriteTimeout:      settings.WriteTimeout,
+		IdleTimeout:       settings.IdleTimeout,
+		MaxHeaderBytes:    settings.MaxHeaderBytes,
+	}
+}
+
+// newMetricsServer returns the plain HTTP server of the metrics, with the same timeouts and limits as the webhook
+// server, so that slow scrapers cannot hold on to connections.
+func newMetricsServer(settings Application) *http.Server {
+	return &http.Server{
+		Addr:              settings.MetricsAddr,
+		Handler:           metricsMux(),
+		ReadHeaderTimeout: settings.ReadTimeout,
+		ReadTimeout:       settings.ReadTimeout,
+		WriteTimeout:      settings.WriteTimeout,
+		IdleTimeout:       settings.IdleTimeout,
+		MaxHeaderBytes:    settings.MaxHeaderBytes,
+	}
+}
+
+// draining marks a replica that is shutting down, so it is removed from the endpoints of the service before it stops
+// accepting connections.
+type draining struct {
+	started int32
+}
+
+func (d *draining) start() {
+	atomic.StoreInt32(&d.started, 1)
+}
+
+// notDraining checks that the replica is not shutting down.
+func notDraining(d *draining) readinessCheck {
+	return func() error {
+		if atomic.LoadInt32(&d.started) != 0 {
+			return errors.New("shutting down")
+		}
+		return nil
+	}
+}
+
+// serveGracefully runs serve until it fails or a signal is received. On a signal the replica becomes not ready but
+// keeps serving for the shutdown delay, while the API server stops sending it requests. Then it stops accepting
+// connections and waits up to the grace period for the in-flight requests to finish.
+func serveGracefully(server *http.Server, serve func() error, drain *draining, settings Application,
+	signals <-chan os.Signal) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- serve()
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case signal := <-signals:
+		logger.Infof("Received %s, shutting down in %s", signal, settings.ShutdownDelay)
+	}
+
+	drain.start()
+	time.Sleep(settings.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.ShutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("in-flight requests did not finish within %s: %v", settings.ShutdownGracePeriod, err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		return err
+	}
+	logger.Infof("Shutdown complete")
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Serves a handler that blocks until release is closed, and the readiness of drain, on a local port.
+func startDrainingServer(t *testing.T, settings Application, release <-chan struct{}) (string, chan os.Signal, <-chan error, <-chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drain := &draining{}
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", readyzHandler(notDraining(drain)))
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	server := &http.Server{Handler: mux}
+	signals := make(chan os.Signal, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- serveGracefully(server, func() error { return server.Serve(listener) }, drain, settings, signals)
+	}()
+	return "http://" + listener.Addr().String(), signals, result, started
+}
+
+func TestServeGracefully(t *testing.T) {
+	release := make(chan struct{})
+	settings := Application{ShutdownDelay: 200 * time.Millisecond, ShutdownGracePeriod: 5 * time.Second}
+	url, signals, result, started := startDrainingServer(t, settings, release)
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-started
+
+	signals <- syscall.SIGTERM
+	time.Sleep(50 * time.Millisecond)
+
+	// Still serving during the shutdown delay, but not ready
+	resp, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatalf("Shutdown delay: Wanted readiness response, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Readiness: Wanted %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	close(release)
+	if body := <-slow; body != "done" {
+		t.Errorf("In-flight request: Wanted done, got %s", body)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Error: Wanted nil, got %v", err)
+	}
+}
+
+func TestServeGracefullyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	settings := Application{ShutdownGracePeriod: 50 * time.Millisecond}
+	url, signals, result, started := startDrainingServer(t, settings, release)
+
+	go http.Get(url + "/slow")
+	<-started
+
+	signals <- syscall.SIGTERM
+	if err := <-result; err == nil {
+		t.Errorf("Error: Wanted in-flight requests not finished, got nil")
+	}
+}
+
+// A scraper that never finishes its request is disconnected after the read timeout
+func TestMetricsServerTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := defaultApplication
+	settings.ReadTimeout = 50 * time.Millisecond
+	server := newMetricsServer(settings)
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET /metrics HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Error: Wanted the connection closed by the server, got %v", err)
+	}
+}
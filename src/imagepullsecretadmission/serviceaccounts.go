@@ -0,0 +1,184 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The image pull secrets of the ServiceAccount are not looked up.
+	serviceAccountSecretsIgnore = `ignore`
+	// Unmanaged image pull secrets of the ServiceAccount are listed in the audit annotations.
+	serviceAccountSecretsReport = `report`
+	// Pods whose ServiceAccount has unmanaged image pull secrets are rejected.
+	serviceAccountSecretsReject = `reject`
+
+	// The ServiceAccount the API server assigns to pods that do not name one.
+	defaultServiceAccount = `default`
+
+	auditServiceAccountSecrets = "unmanaged-service-account-image-pull-secrets"
+)
+
+// serviceAccountLister looks up the ServiceAccounts of pods.
+type serviceAccountLister interface {
+	// ImagePullSecrets returns the names of the image pull secrets of the ServiceAccount, or none if it does not
+	// exist.
+	ImagePullSecrets(namespace string, name string) ([]string, error)
+}
+
+// Creates the lister of the ServiceAccounts. It talks to the API server of the cluster the webhook runs in.
+var newServiceAccountLister = func() (serviceAccountLister, error) {
+	return inClusterClient()
+}
+
+// serviceAccountCheck looks for image pull secrets of the pod's ServiceAccount that are not managed, as the kubelet
+// uses them as well. The mode is one of serviceAccountSecretsIgnore, serviceAccountSecretsReport or
+// serviceAccountSecretsReject.
+type serviceAccountCheck struct {
+	mode   string
+	lister serviceAccountLister
+}
+
+// The check of the ServiceAccounts, set up on startup. Nothing is checked unless it is enabled.
+var serviceAccountSecrets = serviceAccountCheck{mode: serviceAccountSecretsIgnore}
+
+// Sets up the check of the ServiceAccounts with a cached lister, if the settings enable it.
+func startServiceAccountCheck(settings Application) error {
+	if settings.ServiceAccountSecrets == serviceAccountSecretsIgnore {
+		return nil
+	}
+
+	lister, err := newServiceAccountLister()
+	if err != nil {
+		return err
+	}
+	serviceAccountSecrets = serviceAccountCheck{
+		mode:   settings.ServiceAccountSecrets,
+		lister: newCachedServiceAccountLister(lister, settings.ServiceAccountCacheTTL),
+	}
+	return nil
+}
+
+// check looks up the ServiceAccount of the pod and reports its image pull secrets that are neither managed nor kept
+// by the user secret policy of the namespace. In reject mode the pod is rejected instead, also if the lookup fails.
+func (c serviceAccountCheck) check(req *admissionRequest, pod decodedPod, policy UserSecretPolicy, managed []string,
+	result *admissionResult) error {
+	if c.mode == serviceAccountSecretsIgnore || c.lister == nil {
+		return nil
+	}
+
+	name := pod.Spec.ServiceAccountName
+	if name == "" {
+		name = defaultServiceAccount
+	}
+	secrets, err := c.lister.ImagePullSecrets(req.Namespace, name)
+	if err != nil {
+		if c.mode == serviceAccountSecretsReject {
+			return fmt.Errorf("could not look up the image pull secrets of ServiceAccount %q: %v", name, err)
+		}
+		requestLogger(req).Warnf("Could not look up the image pull secrets of ServiceAccount %q: %v", name, err)
+		return nil
+	}
+
+	unmanaged := missingSecrets(uniqueSecrets(secrets), appendMissing(policy.kept(secrets), managed))
+	if len(unmanaged) == 0 {
+		return nil
+	}
+	if c.mode == serviceAccountSecretsReject {
+		return fmt.Errorf("ServiceAccount %q has the image pull secrets %s, which are not managed; remove them "+
+			"from the ServiceAccount or use another one", name, strings.Join(unmanaged, ", "))
+	}
+
+	value, err := json.Marshal(unmanaged)
+	if err != nil {
+		return nil
+	}
+	if result.auditAnnotations == nil {
+		result.auditAnnotations = map[string]string{}
+	}
+	result.auditAnnotations[auditServiceAccountSecrets] = string(value)
+	return nil
+}
+
+// cachedServiceAccountLister keeps the image pull secrets of every looked up ServiceAccount for the TTL, so that
+// the API server is not called for every pod. Failed lookups are not cached.
+type cachedServiceAccountLister struct {
+	lister serviceAccountLister
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cachedServiceAccount
+}
+
+type cachedServiceAccount struct {
+	secrets []string
+	expires time.Time
+}
+
+func newCachedServiceAccountLister(lister serviceAccountLister, ttl time.Duration) *cachedServiceAccountLister {
+	return &cachedServiceAccountLister{
+		lister:  lister,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]cachedServiceAccount{},
+	}
+}
+
+func (l *cachedServiceAccountLister) ImagePullSecrets(namespace string, name string) ([]string, error) {
+	key := namespace + "/" + name
+	now := l.now()
+
+	l.mu.Lock()
+	entry, ok := l.entries[key]
+	l.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.secrets, nil
+	}
+
+	secrets, err := l.lister.ImagePullSecrets(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Expired entries are dropped, so ServiceAccounts that are no longer used do not pile up
+	for cached, entry := range l.entries {
+		if !now.Before(entry.expires) {
+			delete(l.entries, cached)
+		}
+	}
+	l.entries[key] = cachedServiceAccount{secrets: secrets, expires: now.Add(l.ttl)}
+	return secrets, nil
+}
+
+func (c *apiServerClient) ImagePullSecrets(namespace string, name string) ([]string, error) {
+	var serviceAccount struct {
+		ImagePullSecrets []struct {
+			Name string `json:"name"`
+		} `json:"imagePullSecrets"`
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/serviceaccounts/%s", namespace, name)
+	if err := c.do(http.MethodGet, path, "", nil, &serviceAccount); err != nil {
+		if err == errNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var secrets []string
+	for _, secret := range serviceAccount.ImagePullSecrets {
+		secrets = append(secrets, secret.Name)
+	}
+	return secrets, nil
+}
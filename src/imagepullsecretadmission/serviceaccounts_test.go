@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServiceAccountLister serves the image pull secrets of ServiceAccounts by namespace/name.
+type fakeServiceAccountLister struct {
+	secrets map[string][]string
+	err     error
+	calls   int
+}
+
+func (l *fakeServiceAccountLister) ImagePullSecrets(namespace string, name string) ([]string, error) {
+	l.calls++
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.secrets[namespace+"/"+name], nil
+}
+
+func TestServiceAccountSecrets(t *testing.T) {
+	lister := &fakeServiceAccountLister{secrets: map[string][]string{
+		"testns/default":    {"testSecret"},
+		"testns/bypass":     {"team-creds", "testSecret", "other-creds"},
+		"filter-ns/default": {"team-creds", "other-creds"},
+	}}
+	config := defaultConfig
+	config.UserSecretPolicies = []UserSecretPolicy{
+		{Namespaces: []string{"^filter-"}, Policy: userSecretsFilter, Keep: []string{"^team-"}},
+	}
+	config = mustCompile(config)
+
+	tests := map[string]struct {
+		mode           string
+		namespace      string
+		serviceAccount string
+		wantErr        string
+		wantAudit      string
+	}{
+		"ignore": {
+			mode:           serviceAccountSecretsIgnore,
+			namespace:      "testns",
+			serviceAccount: "bypass",
+		},
+		"managed": {
+			mode:      serviceAccountSecretsReject,
+			namespace: "testns",
+		},
+		"missing service account": {
+			mode:           serviceAccountSecretsReject,
+			namespace:      "testns",
+			serviceAccount: "missing",
+		},
+		"report": {
+			mode:           serviceAccountSecretsReport,
+			namespace:      "testns",
+			serviceAccount: "bypass",
+			wantAudit:      `["team-creds","other-creds"]`,
+		},
+		"reject": {
+			mode:           serviceAccountSecretsReject,
+			namespace:      "testns",
+			serviceAccount: "bypass",
+			wantErr:        `ServiceAccount "bypass" has the image pull secrets team-creds, other-creds, which are not managed`,
+		},
+		"filter policy": {
+			mode:      serviceAccountSecretsReport,
+			namespace: "filter-ns",
+			wantAudit: `["other-creds"]`,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			defer func(check serviceAccountCheck) { serviceAccountSecrets = check }(serviceAccountSecrets)
+			serviceAccountSecrets = serviceAccountCheck{mode: test.mode, lister: lister}
+
+			req := podRequest(t, corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: test.namespace},
+				Spec: corev1.PodSpec{
+					Containers:         []corev1.Container{{Image: "test"}},
+					ServiceAccountName: test.serviceAccount,
+				},
+			})
+
+			res, err := manageImagePullSecrets(req, config)
+			if test.wantErr == "" && err != nil {
+				t.Errorf("Error: Wanted nil, got %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("Error: Wanted '%s', got %v", test.wantErr, err)
+			}
+			if audit := res.auditAnnotations[auditServiceAccountSecrets]; audit != test.wantAudit {
+				t.Errorf("Audit annotations: Wanted '%s', got '%s'", test.wantAudit, audit)
+			}
+		})
+	}
+}
+
+// A failed lookup rejects the pod in reject mode, and is only logged in report mode
+func TestServiceAccountSecretsLookupFailure(t *testing.T) {
+	defer func(check serviceAccountCheck) { serviceAccountSecrets = check }(serviceAccountSecrets)
+	lister := &fakeServiceAccountLister{err: errors.New("connection refused")}
+
+	serviceAccountSecrets = serviceAccountCheck{mode: serviceAccountSecretsReject, lister: lister}
+	if _, err := manageImagePullSecrets(podWithSecretsRequest(t, "testns"), defaultConfig); err == nil {
+		t.Errorf("Reject: Wanted error, got nil")
+	}
+
+	serviceAccountSecrets = serviceAccountCheck{mode: serviceAccountSecretsReport, lister: lister}
+	if _, err := manageImagePullSecrets(podWithSecretsRequest(t, "testns"), defaultConfig); err != nil {
+		t.Errorf("Report: Wanted nil, got %v", err)
+	}
+}
+
+func TestCachedServiceAccountLister(t *testing.T) {
+	fake := &fakeServiceAccountLister{secrets: map[string][]string{"testns/default": {"my-creds"}}}
+	now := time.Unix(1000, 0)
+	cached := newCachedServiceAccountLister(fake, time.Minute)
+	cached.now = func() time.Time { return now }
+
+	lookup := func() {
+		secrets, err := cached.ImagePullSecrets("testns", "default")
+		if err != nil {
+			t.Fatalf("Error: Wanted nil, got %v", err)
+		}
+		if !reflect.DeepEqual(secrets, []string{"my-creds"}) {
+			t.Errorf("Result: Wanted [my-creds], got %v", secrets)
+		}
+	}
+
+	lookup()
+	lookup()
+	if fake.calls != 1 {
+		t.Errorf("Cached: Wanted 1 lookup, got %d", fake.calls)
+	}
+
+	now = now.Add(time.Minute)
+	lookup()
+	if fake.calls != 2 {
+		t.Errorf("Expired: Wanted 2 lookups, got %d", fake.calls)
+	}
+
+	fake.err = errors.New("connection refused")
+	now = now.Add(time.Minute)
+	if _, err := cached.ImagePullSecrets("testns", "default"); err == nil {
+		t.Errorf("Failed lookup: Wanted error, got nil")
+	}
+	fake.err = nil
+	lookup()
+	if fake.calls != 4 {
+		t.Errorf("Failed lookup: Wanted it not to be cached, got %d lookups", fake.calls)
+	}
+}
+
+func TestAPIServerClientServiceAccount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/testns/serviceaccounts/default" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"metadata":{"name":"default"},"imagePullSecrets":[{"name":"a"},{"name":"b"}]}`))
+	}))
+	defer server.Close()
+	client := &apiServerClient{host: server.URL, token: "token", client: server.Client()}
+
+	secrets, err := client.ImagePullSecrets("testns", "default")
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if !reflect.DeepEqual(secrets, []string{"a", "b"}) {
+		t.Errorf("Result: Wanted [a b], got %v", secrets)
+	}
+
+	secrets, err = client.ImagePullSecrets("testns", "missing")
+	if err != nil || secrets != nil {
+		t.Errorf("Missing: Wanted no secrets and nil, got %v and %v", secrets, err)
+	}
+}
+
+// Bound service account tokens are rotated, so the token is read again every refresh interval
+func TestAPIServerClientTokenRefresh(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	writeToken := func(token string) {
+		if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	client := &apiServerClient{host: server.URL, tokenFile: tokenFile, client: server.Client()}
+
+	lookup := func(want string) {
+		if _, err := client.ImagePullSecrets("testns", "default"); err != nil {
+			t.Fatalf("Error: Wanted nil, got %v", err)
+		}
+		if authorization != "Bearer "+want {
+			t.Errorf("Authorization: Wanted token %s, got '%s'", want, authorization)
+		}
+	}
+
+	writeToken("first")
+	lookup("first")
+	writeToken("second")
+	lookup("first")
+
+	client.tokenRead = time.Now().Add(-tokenRefreshInterval)
+	lookup("second")
+
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	client.tokenRead = time.Now().Add(-tokenRefreshInterval)
+	lookup("second")
+}
@@ -0,0 +1,277 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Environment variables are the name of the setting in upper snake case with this prefix
+	envPrefix = "IPSA_"
+)
+
+// Application holds the runtime settings of the webhook. They are read from the application section of the config,
+// and each of them can be overridden by an environment variable and a flag of the same name, which take precedence
+// in this order. Settings marked startup are only read when the webhook starts.
+type Application struct {
+	TLSCertFile            string        `yaml:"tlsCertFile" usage:"serving certificate, startup"`
+	TLSKeyFile             string        `yaml:"tlsKeyFile" usage:"key of the serving certificate, startup"`
+	ListenAddr             string        `yaml:"listenAddr" usage:"address the webhooks and probes are served on, startup"`
+	MetricsAddr            string        `yaml:"metricsAddr" usage:"address the metrics are served on over plain HTTP, startup"`
+	ReadTimeout            time.Duration `yaml:"readTimeout" usage:"time to read a request including its body, startup"`
+	WriteTimeout           time.Duration `yaml:"writeTimeout" usage:"time to handle a request and write the response, startup"`
+	IdleTimeout            time.Duration `yaml:"idleTimeout" usage:"time a kept-alive connection waits for the next request, startup"`
+	MaxHeaderBytes         int           `yaml:"maxHeaderBytes" usage:"maximum size of the request headers, startup"`
+	MaxRequestBytes        int           `yaml:"maxRequestBytes" usage:"maximum size of an AdmissionReview, larger ones are answered with 413"`
+	ShutdownDelay          time.Duration `yaml:"shutdownDelay" usage:"time to keep serving while not ready after SIGTERM, startup"`
+	ShutdownGracePeriod    time.Duration `yaml:"shutdownGracePeriod" usage:"time to finish in-flight requests after the shutdown delay, startup"`
+	ConfigReloadInterval   time.Duration `yaml:"configReloadInterval" usage:"how often the config file is checked for changes, startup"`
+	CertReloadInterval     time.Duration `yaml:"certReloadInterval" usage:"how often the key pair is checked for changes, startup"`
+	LogLevel               string        `yaml:"logLevel" usage:"debug, info, warn or error"`
+	StrictReload           bool          `yaml:"strictReload" usage:"not ready while a changed config file is invalid"`
+	CaptureDir             string        `yaml:"captureDir" usage:"write every request and response to this directory"`
+	CaptureRedactEnv       bool          `yaml:"captureRedactEnv" usage:"replace env values in captured requests"`
+	SelfManagedCerts       bool          `yaml:"selfManagedCerts" usage:"generate and rotate the TLS certificates, startup"`
+	CertService            string        `yaml:"certService" usage:"name.namespace of the webhook service, startup"`
+	WebhookConfiguration   string        `yaml:"webhookConfiguration" usage:"webhook configuration to keep the caBundle of up to date, startup"`
+	ServiceAccountSecrets  string        `yaml:"serviceAccountSecrets" usage:"ignore, report or reject unmanaged image pull secrets of the pod's ServiceAccount, startup"`
+	ServiceAccountCacheTTL time.Duration `yaml:"serviceAccountCacheTTL" usage:"how long looked up ServiceAccounts are cached, startup"`
+}
+
+// The settings used for everything that is not set in the config, the environment or by a flag.
+var defaultApplication = Application{
+	TLSCertFile:            `/run/secrets/tls/tls.crt`,
+	TLSKeyFile:             `/run/secrets/tls/tls.key`,
+	ListenAddr:             ":8443",
+	MetricsAddr:            ":9090",
+	ReadTimeout:            10 * time.Second,
+	WriteTimeout:           30 * time.Second,
+	IdleTimeout:            2 * time.Minute,
+	MaxHeaderBytes:         1 << 20,
+	MaxRequestBytes:        6 << 20,
+	ShutdownDelay:          5 * time.Second,
+	ShutdownGracePeriod:    20 * time.Second,
+	ConfigReloadInterval:   10 * time.Second,
+	CertReloadInterval:     10 * time.Second,
+	LogLevel:               "info",
+	CaptureRedactEnv:       true,
+	CertService:            "webhook-server.webhook-demo",
+	ServiceAccountSecrets:  serviceAccountSecretsIgnore,
+	ServiceAccountCacheTTL: 30 * time.Second,
+}
+
+// UnmarshalYAML rejects numbers without a unit for durations, which would otherwise be read as nanoseconds.
+func (a *Application) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var errs []string
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err == nil {
+		for _, field := range settingFields() {
+			if field.Type != reflect.TypeOf(time.Duration(0)) {
+				continue
+			}
+			name := field.Tag.Get("yaml")
+			switch value := raw[name].(type) {
+			case int, int64, uint64, float64:
+				errs = append(errs, fmt.Sprintf("application.%s: %v is not a duration, it needs a unit like 10s", name, value))
+			}
+		}
+	}
+
+	// Without the method, the settings are decoded as usual, on top of the defaults
+	type settings Application
+	if err := unmarshal((*settings)(a)); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return err
+		}
+		errs = append(errs, typeErr.Errors...)
+	}
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+	return nil
+}
+
+// settingOverride is the value of a setting given by an environment variable or a flag.
+type settingOverride struct {
+	name   string
+	value  string
+	source string
+}
+
+// The overrides of the settings that are applied to every loaded config, in order. They are only set for the
+// webhook server, not for subcommands.
+var settingOverrides []settingOverride
+
+// parseSettings reads the environment and the flags of the webhook server. It returns the path of the config file
+// and the overrides of the settings, environment variables first so that flags take precedence.
+func parseSettings(args []string, lookupEnv func(string) (string, bool), output io.Writer) (string, []settingOverride, error) {
+	configPath := configFile
+	if value, ok := lookupEnv(envName("config")); ok {
+		configPath = value
+	}
+
+	var overrides []settingOverride
+	for _, name := range settingNames() {
+		if value, ok := lookupEnv(envName(name)); ok {
+			overrides = append(overrides, settingOverride{name: name, value: value, source: "environment variable " + envName(name)})
+		}
+	}
+
+	flags := flag.NewFlagSet("imagepullsecretadmission", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&configPath, "config", configPath, "config file (env "+envName("config")+")")
+	for _, field := range settingFields() {
+		name := field.Tag.Get("yaml")
+		flags.Var(&settingFlag{name: name, overrides: &overrides, isBool: field.Type.Kind() == reflect.Bool},
+			name, fmt.Sprintf("%s (env %s)", field.Tag.Get("usage"), envName(name)))
+	}
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+	if flags.NArg() > 0 {
+		return "", nil, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+	return configPath, overrides, nil
+}
+
+// settingFlag adds an override for every time the flag is given.
+type settingFlag struct {
+	name      string
+	overrides *[]settingOverride
+	isBool    bool
+}
+
+func (f *settingFlag) String() string {
+	return ""
+}
+
+func (f *settingFlag) Set(value string) error {
+	*f.overrides = append(*f.overrides, settingOverride{name: f.name, value: value, source: "flag -" + f.name})
+	return nil
+}
+
+// IsBoolFlag allows boolean settings to be given as -name instead of -name=true.
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func settingFields() []reflect.StructField {
+	t := reflect.TypeOf(Application{})
+	fields := make([]reflect.StructField, t.NumField())
+	for i := range fields {
+		fields[i] = t.Field(i)
+	}
+	return fields
+}
+
+func settingNames() []string {
+	var names []string
+	for _, field := range settingFields() {
+		names = append(names, field.Tag.Get("yaml"))
+	}
+	return names
+}
+
+// envName returns the environment variable of a setting, e.g. IPSA_TLS_CERT_FILE for tlsCertFile.
+func envName(name string) string {
+	var env strings.Builder
+	env.WriteString(envPrefix)
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(rune(name[i-1])) {
+			env.WriteByte('_')
+		}
+		env.WriteRune(unicode.ToUpper(r))
+	}
+	return env.String()
+}
+
+// override sets the setting to the value, parsed according to its type.
+func (a *Application) override(override settingOverride, errs *configErrors) {
+	settings := reflect.ValueOf(a).Elem()
+	for i, field := range settingFields() {
+		if field.Tag.Get("yaml") != override.name {
+			continue
+		}
+
+		value := settings.Field(i)
+		switch value.Interface().(type) {
+		case string:
+			value.SetString(override.value)
+		case int:
+			parsed, err := strconv.Atoi(override.value)
+			if err != nil {
+				errs.add(override.source, "%q is not an integer", override.value)
+			}
+			value.SetInt(int64(parsed))
+		case bool:
+			parsed, err := strconv.ParseBool(override.value)
+			if err != nil {
+				errs.add(override.source, "%q is not a boolean", override.value)
+			}
+			value.SetBool(parsed)
+		case time.Duration:
+			parsed, err := time.ParseDuration(override.value)
+			if err != nil {
+				errs.add(override.source, "%q is not a duration", override.value)
+			}
+			value.SetInt(int64(parsed))
+		}
+		return
+	}
+}
+
+// validate checks the settings that cannot be checked by their type.
+func (a Application) validate(path string, errs *configErrors) {
+	positive := []struct {
+		name  string
+		value int64
+	}{
+		{"readTimeout", int64(a.ReadTimeout)},
+		{"writeTimeout", int64(a.WriteTimeout)},
+		{"idleTimeout", int64(a.IdleTimeout)},
+		{"maxHeaderBytes", int64(a.MaxHeaderBytes)},
+		{"maxRequestBytes", int64(a.MaxRequestBytes)},
+		{"shutdownGracePeriod", int64(a.ShutdownGracePeriod)},
+		{"configReloadInterval", int64(a.ConfigReloadInterval)},
+		{"certReloadInterval", int64(a.CertReloadInterval)},
+		{"serviceAccountCacheTTL", int64(a.ServiceAccountCacheTTL)},
+	}
+	for _, setting := range positive {
+		if setting.value <= 0 {
+			errs.add(path+"."+setting.name, "must be positive")
+		}
+	}
+	if a.ShutdownDelay < 0 {
+		errs.add(path+".shutdownDelay", "must not be negative")
+	}
+	required := []struct{ name, value string }{
+		{"tlsCertFile", a.TLSCertFile},
+		{"tlsKeyFile", a.TLSKeyFile},
+		{"listenAddr", a.ListenAddr},
+		{"metricsAddr", a.MetricsAddr},
+	}
+	for _, setting := range required {
+		if setting.value == "" {
+			errs.add(path+"."+setting.name, "must not be empty")
+		}
+	}
+	switch a.ServiceAccountSecrets {
+	case serviceAccountSecretsIgnore, serviceAccountSecretsReport, serviceAccountSecretsReject:
+	default:
+		errs.add(path+".serviceAccountSecrets", "invalid mode %q, must be %s, %s or %s", a.ServiceAccountSecrets,
+			serviceAccountSecretsIgnore, serviceAccountSecretsReport, serviceAccountSecretsReject)
+	}
+}
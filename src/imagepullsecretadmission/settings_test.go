@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"config":               "IPSA_CONFIG",
+		"tlsCertFile":          "IPSA_TLS_CERT_FILE",
+		"configReloadInterval": "IPSA_CONFIG_RELOAD_INTERVAL",
+	}
+	for name, want := range tests {
+		if env := envName(name); env != want {
+			t.Errorf("%s: Wanted %s, got %s", name, want, env)
+		}
+	}
+}
+
+// Parses the config with the overrides from the environment and the flags.
+func parseConfigWithSettings(t *testing.T, content string, env map[string]string, args ...string) (string, Config, error) {
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	configPath, overrides, err := parseSettings(args, lookupEnv, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+
+	settingOverrides = overrides
+	defer func() { settingOverrides = nil }()
+	config, err := parseConfig([]byte(content))
+	return configPath, config, err
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	const content = `
+application:
+  logLevel: warn
+  listenAddr: ":9443"
+  captureDir: /var/run/ipsa
+imagePullSecretRules: {}
+`
+	env := map[string]string{
+		"IPSA_LOG_LEVEL":              "error",
+		"IPSA_LISTEN_ADDR":            ":10443",
+		"IPSA_STRICT_RELOAD":          "true",
+		"IPSA_CONFIG_RELOAD_INTERVAL": "1m",
+		"IPSA_CONFIG":                 "/etc/other/config.yaml",
+	}
+
+	configPath, config, err := parseConfigWithSettings(t, content, env, "-listenAddr", ":11443", "-selfManagedCerts")
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if configPath != "/etc/other/config.yaml" {
+		t.Errorf("Config path: Wanted the environment, got %s", configPath)
+	}
+
+	settings := config.Application
+	want := defaultApplication
+	want.ListenAddr = ":11443"
+	want.ConfigReloadInterval = time.Minute
+	want.LogLevel = "error"
+	want.StrictReload = true
+	want.CaptureDir = "/var/run/ipsa"
+	want.SelfManagedCerts = true
+	if settings != want {
+		t.Errorf("Result: Wanted %+v, got %+v", want, settings)
+	}
+	if config.logLevel != levelError || config.certService != "webhook-server" {
+		t.Errorf("Compiled: Wanted error level and webhook-server, got %v and %s", config.logLevel, config.certService)
+	}
+}
+
+func TestSettingsInvalid(t *testing.T) {
+	tests := map[string]struct {
+		config string
+		env    map[string]string
+		args   []string
+		want   string
+	}{
+		"environment": {
+			env:  map[string]string{"IPSA_STRICT_RELOAD": "sometimes"},
+			want: `environment variable IPSA_STRICT_RELOAD: "sometimes" is not a boolean`,
+		},
+		"flag": {
+			args: []string{"-certReloadInterval", "often"},
+			want: `flag -certReloadInterval: "often" is not a duration`,
+		},
+		"integer": {
+			env:  map[string]string{"IPSA_MAX_REQUEST_BYTES": "6MB"},
+			want: `environment variable IPSA_MAX_REQUEST_BYTES: "6MB" is not an integer`,
+		},
+		"duration without unit": {
+			config: "application:\n  readTimeout: 5\n",
+			want:   "application.readTimeout: 5 is not a duration",
+		},
+		"validated": {
+			args: []string{"-certReloadInterval", "-1s"},
+			want: "application.certReloadInterval: must be positive",
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			_, _, err := parseConfigWithSettings(t, test.config+validConfigYAML, test.env, test.args...)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Error: Wanted %q, got %v", test.want, err)
+			}
+		})
+	}
+
+	if _, _, err := parseSettings([]string{"-unknown"}, func(string) (string, bool) { return "", false },
+		ioutil.Discard); err == nil {
+		t.Errorf("Unknown flag: Wanted error, got nil")
+	}
+}
+
+// An application section whose settings are all commented out keeps the defaults
+func TestSettingsEmptyApplication(t *testing.T) {
+	config, err := parseConfig([]byte("application:\n#  logLevel: debug\n" + validConfigYAML))
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if config.Application != defaultApplication {
+		t.Errorf("Result: Wanted %+v, got %+v", defaultApplication, config.Application)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// certReloader serves the TLS key pair from disk and reloads it when the files change, e.g. when cert-manager
+// renews the secret. A new key pair is only used once it is valid, until then the previous one is served.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	err     error
+	checked time.Time
+
+	// checksum of the key pair that was last loaded
+	checksum []byte
+	// checksum of the key pair that was last rejected, which is only reported once
+	rejected []byte
+	// error of the last read of the files, empty if they could be read
+	readErr string
+}
+
+func newCertReloader(certPath string, keyPath string, interval time.Duration) *certReloader {
+	return &certReloader{certPath: certPath, keyPath: keyPath, interval: interval, now: time.Now}
+}
+
+// GetCertificate is the callback of the TLS server config, called for every handshake.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// certificate returns the active key pair, after reloading it if the interval has passed since the last check.
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := r.now(); now.Sub(r.checked) >= r.interval {
+		r.checked = now
+		r.reload()
+	}
+	if r.cert == nil {
+		return nil, fmt.Errorf("no TLS key pair loaded: %v", r.err)
+	}
+	return r.cert, nil
+}
+
+// Loads the key pair if the content of the files changed. An invalid key pair is logged
+// and otherwise ignored, the last good one stays active. It is checked again every interval,
+// as a certificate that is not valid yet, e.g. because of clock skew with the issuer, becomes
+// valid without the files changing.
+func (r *certReloader) reload() {
+	certPEM, keyPEM, err := r.read()
+	if err != nil {
+		// Like a rejected key pair, a read error is only logged and counted when it first appears or changes
+		if err.Error() != r.readErr {
+			r.readErr = err.Error()
+			r.failReload(err)
+		}
+		r.err = err
+		return
+	}
+	r.readErr = ""
+
+	checksum := sha256.Sum256(append(append([]byte{}, certPEM...), keyPEM...))
+	if bytes.Equal(checksum[:], r.checksum) {
+		r.err = nil
+		return
+	}
+
+	cert, err := parseKeyPair(certPEM, keyPEM, r.now())
+	if err != nil {
+		if bytes.Equal(checksum[:], r.rejected) {
+			r.err = err
+			return
+		}
+		r.rejected = checksum[:]
+		r.failReload(err)
+		return
+	}
+
+	r.checksum, r.rejected = checksum[:], nil
+	r.cert, r.err = cert, nil
+	observeCertReload(nil, cert.Leaf.NotAfter)
+	logger.Infof("TLS key pair loaded from %s, expires %s", r.certPath, cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+}
+
+func (r *certReloader) read() ([]byte, []byte, error) {
+	certPEM, err := ioutil.ReadFile(r.certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(r.keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func (r *certReloader) failReload(err error) {
+	r.err = err
+	observeCertReload(err, time.Time{})
+	if r.cert != nil {
+		logger.Errorf("TLS key pair reload failed, keeping the active key pair: %v", err)
+	}
+}
+
+// parseKeyPair checks that the key belongs to the certificate and that the certificate is valid at the given time.
+func parseKeyPair(certPEM []byte, keyPEM []byte, now time.Time) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if now.After(cert.Leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %s", cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if now.Before(cert.Leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate is not valid before %s", cert.Leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	return &cert, nil
+}
+
+// certificateReady checks that a key pair is loaded and that its certificate has not expired since.
+func certificateReady(certs *certReloader) readinessCheck {
+	return func() error {
+		cert, err := certs.certificate()
+		if err != nil {
+			return err
+		}
+		if time.Now().After(cert.Leaf.NotAfter) {
+			return errors.New("TLS certificate has expired")
+		}
+		return nil
+	}
+}
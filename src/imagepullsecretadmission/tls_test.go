@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipsa-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := writeTestKeyPair(t, dir)
+	certs := newCertReloader(certPath, keyPath, 0)
+	first, err := certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if value := certExpiry.gauges[""]; value != float64(first.Leaf.NotAfter.Unix()) {
+		t.Errorf("Expiry: Wanted %d, got %v", first.Leaf.NotAfter.Unix(), value)
+	}
+
+	// Renewed by cert-manager
+	notAfter := time.Now().Add(24 * time.Hour)
+	writeTestKeyPairValid(t, dir, time.Now().Add(-time.Hour), notAfter)
+	renewed, err := certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if renewed == first || renewed.Leaf.NotAfter.Unix() != notAfter.Unix() {
+		t.Errorf("Result: Wanted renewed certificate expiring %s, got %s", notAfter, renewed.Leaf.NotAfter)
+	}
+	if value := certExpiry.gauges[""]; value != float64(notAfter.Unix()) {
+		t.Errorf("Expiry: Wanted %d, got %v", notAfter.Unix(), value)
+	}
+
+	// Invalid key pairs are not served
+	invalid := map[string]func(){
+		"expired": func() {
+			writeTestKeyPairValid(t, dir, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+		},
+		"not yet valid": func() {
+			writeTestKeyPairValid(t, dir, time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+		},
+		"mismatched key": func() {
+			key, err := ioutil.ReadFile(keyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestKeyPair(t, dir)
+			if err := ioutil.WriteFile(keyPath, key, 0600); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"missing": func() {
+			os.Remove(certPath)
+		},
+	}
+	for name, write := range invalid {
+		write := write
+		t.Run(name, func(t *testing.T) {
+			failures := counterValue(certReloads, reloadFailure)
+			write()
+			cert, err := certs.GetCertificate(nil)
+			if err != nil || cert != renewed {
+				t.Errorf("Result: Wanted the last good certificate, got %v", err)
+			}
+			if counterValue(certReloads, reloadFailure) != failures+1 {
+				t.Errorf("Metric: Wanted failed reload counted")
+			}
+		})
+	}
+}
+
+func TestCertReloadInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipsa-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := writeTestKeyPair(t, dir)
+	certs := newCertReloader(certPath, keyPath, time.Hour)
+	first, err := certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+
+	writeTestKeyPair(t, dir)
+	if cert, err := certs.GetCertificate(nil); err != nil || cert != first {
+		t.Errorf("Result: Wanted no reload before the interval passed, got %v", err)
+	}
+}
+
+// A renewed certificate that is not valid yet, e.g. because of clock skew with the issuer, is served once it is
+func TestCertReloadNotYetValid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipsa-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := writeTestKeyPair(t, dir)
+	certs := newCertReloader(certPath, keyPath, 0)
+	first, err := certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+
+	failures := counterValue(certReloads, reloadFailure)
+	writeTestKeyPairValid(t, dir, time.Now().Add(time.Minute), time.Now().Add(24*time.Hour))
+	for i := 0; i < 2; i++ {
+		if cert, err := certs.GetCertificate(nil); err != nil || cert != first {
+			t.Errorf("Not yet valid: Wanted the active certificate, got %v", err)
+		}
+	}
+	if diff := counterValue(certReloads, reloadFailure) - failures; diff != 1 {
+		t.Errorf("Metric: Wanted the rejected key pair counted once, got %v", diff)
+	}
+
+	certs.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if cert, err := certs.GetCertificate(nil); err != nil || cert == first {
+		t.Errorf("Valid: Wanted the renewed certificate, got %v", err)
+	}
+}
+
+// A key pair that cannot be read, e.g. while the secret volume is updated, is reported once and not every interval
+func TestCertReloadReadError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipsa-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := writeTestKeyPair(t, dir)
+	certs := newCertReloader(certPath, keyPath, 0)
+	first, err := certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	cert, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures := counterValue(certReloads, reloadFailure)
+	if err := os.Remove(certPath); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if cert, err := certs.GetCertificate(nil); err != nil || cert != first {
+			t.Errorf("Missing: Wanted the active certificate, got %v", err)
+		}
+	}
+	if diff := counterValue(certReloads, reloadFailure) - failures; diff != 1 {
+		t.Errorf("Metric: Wanted the read error counted once, got %v", diff)
+	}
+
+	if err := ioutil.WriteFile(certPath, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := certs.GetCertificate(nil); err != nil || cert != first || certs.err != nil {
+		t.Errorf("Restored: Wanted the active certificate and no error, got %v and %v", err, certs.err)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// Only the managed secrets stay on the pod.
+	userSecretsReplace = `replace`
+	// The user secrets are kept and the managed secrets are added to them.
+	userSecretsMerge = `merge`
+	// Only the user secrets whose names match a keep regex are kept, the managed secrets are added to them.
+	userSecretsFilter = `filter`
+)
+
+// UserSecretPolicy decides which of the image pull secrets the user put on a pod are kept in namespaces matching
+// any of the Namespaces regexes. Policy is one of userSecretsReplace, userSecretsMerge or userSecretsFilter, which
+// keeps the secrets matching any of the Keep regexes.
+type UserSecretPolicy struct {
+	Namespaces []string `yaml:"namespaces"`
+	Policy     string   `yaml:"policy"`
+	Keep       []string `yaml:"keep,omitempty"`
+
+	namespaces []*regexp.Regexp
+	keep       []*regexp.Regexp
+}
+
+// The policy of namespaces without a matching entry in userSecretPolicies.
+var defaultUserSecretPolicy = UserSecretPolicy{Policy: userSecretsReplace}
+
+// Returns the first policy matching the namespace, or the default policy.
+func userSecretPolicy(config Config, namespace string) UserSecretPolicy {
+	for _, policy := range config.UserSecretPolicies {
+		if matchesAny(policy.namespaces, namespace) {
+			return policy
+		}
+	}
+	return defaultUserSecretPolicy
+}
+
+// Returns the user secrets the policy keeps, in their order on the pod and without duplicates.
+func (p UserSecretPolicy) kept(secrets []string) []string {
+	switch p.Policy {
+	case userSecretsMerge:
+		return uniqueSecrets(secrets)
+	case userSecretsFilter:
+		var kept []string
+		for _, secret := range uniqueSecrets(secrets) {
+			if matchesAny(p.keep, secret) {
+				kept = append(kept, secret)
+			}
+		}
+		return kept
+	}
+	return nil
+}
+
+// Checks the policy and compiles its regexes.
+func (p UserSecretPolicy) compile(path string, errs *configErrors) UserSecretPolicy {
+	if len(p.Namespaces) == 0 {
+		errs.add(path+".namespaces", "at least one namespace regex is required")
+	}
+	p.namespaces = nil
+	for i, namespaceRegex := range p.Namespaces {
+		p.namespaces = append(p.namespaces, errs.regexp(fmt.Sprintf("%s.namespaces[%d]", path, i), namespaceRegex))
+	}
+
+	switch p.Policy {
+	case userSecretsReplace, userSecretsMerge:
+		if len(p.Keep) > 0 {
+			errs.add(path+".keep", "only allowed with policy %s", userSecretsFilter)
+		}
+	case userSecretsFilter:
+		if len(p.Keep) == 0 {
+			errs.add(path+".keep", "at least one secret name regex is required")
+		}
+	default:
+		errs.add(path+".policy", "invalid policy %q, must be %s, %s or %s",
+			p.Policy, userSecretsReplace, userSecretsMerge, userSecretsFilter)
+	}
+
+	p.keep = nil
+	for i, keepRegex := range p.Keep {
+		p.keep = append(p.keep, errs.regexp(fmt.Sprintf("%s.keep[%d]", path, i), keepRegex))
+	}
+	return p
+}
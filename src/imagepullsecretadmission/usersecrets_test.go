@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUserSecretPolicyAdmission(t *testing.T) {
+	config := defaultConfig
+	config.UserSecretPolicies = []UserSecretPolicy{
+		{Namespaces: []string{"^merge-"}, Policy: userSecretsMerge},
+		{Namespaces: []string{"^filter-"}, Policy: userSecretsFilter, Keep: []string{"^team-", "^testSecret$"}},
+		{Namespaces: []string{".*"}, Policy: userSecretsReplace},
+	}
+	config = mustCompile(config)
+
+	tests := map[string]struct {
+		namespace string
+		secrets   []string
+		want      []string
+		removed   []string
+	}{
+		"replace": {
+			namespace: "testns",
+			secrets:   []string{"my-creds", "team-creds"},
+			want:      []string{"testSecret"},
+			removed:   []string{"my-creds", "team-creds"},
+		},
+		"merge": {
+			namespace: "merge-a",
+			secrets:   []string{"my-creds", "team-creds"},
+			want:      []string{"my-creds", "team-creds", "testSecret"},
+		},
+		"merge duplicates": {
+			namespace: "merge-a",
+			secrets:   []string{"my-creds", "testSecret", "my-creds"},
+			want:      []string{"my-creds", "testSecret"},
+		},
+		"filter": {
+			namespace: "filter-a",
+			secrets:   []string{"my-creds", "team-creds"},
+			want:      []string{"team-creds", "testSecret"},
+			removed:   []string{"my-creds"},
+		},
+		"filter managed secret": {
+			namespace: "filter-a",
+			secrets:   []string{"testSecret", "team-creds", "team-creds"},
+			want:      []string{"testSecret", "team-creds"},
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			res, err := manageImagePullSecrets(podWithSecretsRequest(t, test.namespace, test.secrets...), config)
+			if err != nil {
+				t.Fatalf("Error: Wanted nil, got %v", err)
+			}
+			patched, err := applyPatch(podWithSecretsRequest(t, test.namespace, test.secrets...).Object.Raw, res.patches)
+			if err != nil {
+				t.Fatalf("Error: Wanted nil, got %v", err)
+			}
+			pod, err := decodePod(patched)
+			if err != nil {
+				t.Fatalf("Error: Wanted nil, got %v", err)
+			}
+			if got := secretNames(pod.Spec.ImagePullSecrets); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Result: Wanted %v, got %v", test.want, got)
+			}
+			if len(res.removedSecrets) > 0 || len(test.removed) > 0 {
+				if !reflect.DeepEqual(res.removedSecrets, test.removed) {
+					t.Errorf("Removed: Wanted %v, got %v", test.removed, res.removedSecrets)
+				}
+			}
+		})
+	}
+}
+
+// The break-glass annotation and keepUserSecrets exclusions keep all user secrets, whatever the policy
+func TestUserSecretPolicyKeepUserSecrets(t *testing.T) {
+	config := defaultConfig
+	config.ExcludedNamespaces = []NamespaceExclusion{{Name: "testns", Mode: exclusionKeepUserSecrets}}
+	config.UserSecretPolicies = []UserSecretPolicy{{Namespaces: []string{".*"}, Policy: userSecretsReplace}}
+	config = mustCompile(config)
+
+	res, err := manageImagePullSecrets(podWithSecretsRequest(t, "testns", "my-creds"), config)
+	if err != nil {
+		t.Fatalf("Error: Wanted nil, got %v", err)
+	}
+	if len(res.removedSecrets) != 0 || !reflect.DeepEqual(res.addedSecrets, []string{"testSecret"}) {
+		t.Errorf("Result: Wanted testSecret added to my-creds, got %+v", res)
+	}
+}
+
+func TestUserSecretPolicyInvalid(t *testing.T) {
+	tests := map[string]struct {
+		policy UserSecretPolicy
+		want   string
+	}{
+		"invalid policy":  {UserSecretPolicy{Namespaces: []string{".*"}, Policy: "keep"}, "userSecretPolicies[0].policy: invalid policy"},
+		"no policy":       {UserSecretPolicy{Namespaces: []string{".*"}}, "userSecretPolicies[0].policy: invalid policy"},
+		"no namespaces":   {UserSecretPolicy{Policy: userSecretsMerge}, "userSecretPolicies[0].namespaces: at least one"},
+		"namespace regex": {UserSecretPolicy{Namespaces: []string{"("}, Policy: userSecretsMerge}, "userSecretPolicies[0].namespaces[0]: invalid regex"},
+		"filter no keep":  {UserSecretPolicy{Namespaces: []string{".*"}, Policy: userSecretsFilter}, "userSecretPolicies[0].keep: at least one"},
+		"keep regex":      {UserSecretPolicy{Namespaces: []string{".*"}, Policy: userSecretsFilter, Keep: []string{"("}}, "userSecretPolicies[0].keep[0]: invalid regex"},
+		"merge with keep": {UserSecretPolicy{Namespaces: []string{".*"}, Policy: userSecretsMerge, Keep: []string{".*"}}, "userSecretPolicies[0].keep: only allowed"},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			_, err := Config{UserSecretPolicies: []UserSecretPolicy{test.policy}}.compile()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Error: Wanted '%v', got %v", test.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceAccountDir = `/var/run/secrets/kubernetes.io/serviceaccount`
+
+	jsonPatchContentType = `application/json-patch+json`
+
+	// How often the token is read again, as bound service account tokens are rotated by the kubelet
+	tokenRefreshInterval = time.Minute
+)
+
+// The resources of the webhook configurations the webhook is registered with.
+var webhookConfigurationResources = []string{"mutatingwebhookconfigurations", "validatingwebhookconfigurations"}
+
+// The API server answered 404, the requested object does not exist.
+var errNotFound = errors.New("not found")
+
+// webhookClient updates the webhook configurations in the cluster.
+type webhookClient interface {
+	// SetCABundle sets the caBundle of all webhooks of the named configuration of the resource, or returns
+	// errNotFound if the configuration does not exist.
+	SetCABundle(resource string, name string, caBundle []byte) error
+}
+
+// Creates the client used to update the webhook configurations. It talks to the API server of the cluster the
+// webhook runs in.
+var newWebhookClient = func() (webhookClient, error) {
+	return inClusterClient()
+}
+
+// apiServerClient calls the API server with a bearer token. The token is read from tokenFile, if it is set.
+type apiServerClient struct {
+	host      string
+	tokenFile string
+	client    *http.Client
+
+	mu        sync.Mutex
+	token     string
+	tokenRead time.Time
+}
+
+// inClusterClient returns a client authenticated as the service account of the pod.
+func inClusterClient() (*apiServerClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, caCertFile))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(serviceAccountDir, caCertFile))
+	}
+
+	client := &apiServerClient{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		},
+	}
+	if _, err := client.bearerToken(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// bearerToken returns the token, after reading it again if the refresh interval has passed. If it cannot be read
+// again, the last token is used until it can.
+func (c *apiServerClient) bearerToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokenFile == "" || time.Since(c.tokenRead) < tokenRefreshInterval {
+		return c.token, nil
+	}
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		if c.token == "" {
+			return "", err
+		}
+		logger.Warnf("Cannot read the service account token again, using the last one: %v", err)
+		return c.token, nil
+	}
+	c.token, c.tokenRead = strings.TrimSpace(string(token)), time.Now()
+	return c.token, nil
+}
+
+func (c *apiServerClient) SetCABundle(resource string, name string, caBundle []byte) error {
+	path := fmt.Sprintf("/apis/admissionregistration.k8s.io/v1/%s/%s", resource, name)
+
+	var config struct {
+		Webhooks []struct {
+			Name string `json:"name"`
+		} `json:"webhooks"`
+	}
+	if err := c.do(http.MethodGet, path, "", nil, &config); err != nil {
+		return err
+	}
+	if len(config.Webhooks) == 0 {
+		return nil
+	}
+
+	patch := make([]patchOperation, len(config.Webhooks))
+	for i := range config.Webhooks {
+		patch[i] = patchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("/webhooks/%d/clientConfig/caBundle", i),
+			Value: base64.StdEncoding.EncodeToString(caBundle),
+		}
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPatch, path, jsonPatchContentType, body, nil)
+}
+
+// Sends a request and decodes the response into result, if it is not nil.
+func (c *apiServerClient) do(method string, path string, contentType string, body []byte, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	token, err := c.bearerToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, c.host+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", jsonContentType)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, content)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(content, result)
+}
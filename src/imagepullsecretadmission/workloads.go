@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// JSON pointers to the pod spec, used as prefix of the JSON patches
+	podSpecPath             = `/spec`
+	templateSpecPath        = `/spec/template/spec`
+	cronJobTemplateSpecPath = `/spec/jobTemplate/spec/template/spec`
+)
+
+var (
+	deploymentResource     = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	statefulSetResource    = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}
+	daemonSetResource      = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}
+	jobResource            = metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	cronJobResource        = metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"}
+	cronJobV1beta1Resource = metav1.GroupVersionResource{Group: "batch", Version: "v1beta1", Resource: "cronjobs"}
+
+	// The resources the admission controllers handle, with the path of their pod spec.
+	podSpecPaths = map[metav1.GroupVersionResource]string{
+		podResource:            podSpecPath,
+		deploymentResource:     templateSpecPath,
+		statefulSetResource:    templateSpecPath,
+		daemonSetResource:      templateSpecPath,
+		jobResource:            templateSpecPath,
+		cronJobResource:        cronJobTemplateSpecPath,
+		cronJobV1beta1Resource: cronJobTemplateSpecPath,
+	}
+)
+
+// Checks whether the admission controllers handle the resource and subresource
+// of the request. Workloads are only handled as a whole, pods also through
+// their ephemeralcontainers subresource.
+func supportedResource(req *admissionRequest) bool {
+	if _, ok := podSpecPaths[req.Resource]; !ok {
+		return false
+	}
+	return req.SubResource == "" || (req.Resource == podResource && req.SubResource == ephemeralContainersSubResource)
+}
+
+// Checks whether the pod template of the request cannot be changed. The
+// template of a Job is immutable, so it is only handled when the Job is
+// created; an update of an existing Job must not be patched or rejected
+// because of rules that changed since.
+func immutableTemplate(req *admissionRequest) bool {
+	return req.Resource == jobResource && req.Operation == v1beta1.Update
+}
+
+// Decodes the Pod of the request, or the pod template of a workload. The name
+// of a pod template is the name of its workload, so it can be named in messages.
+func decodeAdmissionObject(req *admissionRequest) (decodedPod, error) {
+	specPath := podSpecPaths[req.Resource]
+	if specPath == podSpecPath {
+		return decodePod(req.Object.Raw)
+	}
+
+	var workload struct {
+		metav1.ObjectMeta `json:"metadata"`
+		Spec              struct {
+			Template    corev1.PodTemplateSpec `json:"template"`
+			JobTemplate struct {
+				Spec struct {
+					Template corev1.PodTemplateSpec `json:"template"`
+				} `json:"spec"`
+			} `json:"jobTemplate"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(req.Object.Raw, &workload); err != nil {
+		return decodedPod{}, fmt.Errorf("could not deserialize %s object: %v", req.Resource.Resource, err)
+	}
+
+	template := workload.Spec.Template
+	if specPath == cronJobTemplateSpecPath {
+		template = workload.Spec.JobTemplate.Spec.Template
+	}
+
+	pod := decodedPod{
+		Pod:      corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec},
+		SpecPath: specPath,
+	}
+	pod.Name = workload.Name
+	pod.GenerateName = workload.GenerateName
+	pod.Namespace = workload.Namespace
+	return pod, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+// Builds an AdmissionRequest for a workload in testns whose pod template has
+// a single container with the given image and a user-provided pull secret.
+func workloadRequest(t *testing.T, resource metav1.GroupVersionResource, image string) *admissionRequest {
+	return templateRequest(t, resource, corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "testns"},
+		Spec: corev1.PodSpec{
+			Containers:       []corev1.Container{{Name: "app", Image: image}},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "my-creds"}},
+		},
+	})
+}
+
+func TestWorkloadAdmission(t *testing.T) {
+	tests := map[metav1.GroupVersionResource]string{
+		deploymentResource:     "/spec/template/spec",
+		statefulSetResource:    "/spec/template/spec",
+		daemonSetResource:      "/spec/template/spec",
+		jobResource:            "/spec/template/spec",
+		cronJobResource:        "/spec/jobTemplate/spec/template/spec",
+		cronJobV1beta1Resource: "/spec/jobTemplate/spec/template/spec",
+	}
+
+	for resource, specPath := range tests {
+		resource, specPath := resource, specPath
+		t.Run(resource.String(), func(t *testing.T) {
+			res, err := manageImagePullSecrets(workloadRequest(t, resource, "test"), defaultConfig)
+			if err != nil {
+				t.Fatalf("Error: Wanted nil, got %v", err)
+			}
+
+			if len(res.patches) != 1 {
+				t.Fatalf("Result: Wanted a single patch, got %v", res.patches)
+			}
+			if res.patches[0].Op != "replace" || res.patches[0].Path != specPath+"/imagePullSecrets" ||
+				patchValue(t, res.patches[0]) != `[{"name":"testSecret"}]` {
+				t.Errorf("Result: Expected user secrets replaced by testSecret at %s, got '%v'", specPath, res.patches[0])
+			}
+		})
+	}
+}
+
+func TestWorkloadImageAdmission(t *testing.T) {
+	config := mustCompile(Config{
+		ImageAdmissionRules: map[string][]ImageMatcher{".*": {{Registry: "gcr.io"}}},
+	})
+
+	if _, err := admitPodImages(workloadRequest(t, cronJobResource, "gcr.io/team/app"), config); err != nil {
+		t.Errorf("Error: Wanted nil, got %v", err)
+	}
+
+	_, err := admitPodImages(workloadRequest(t, deploymentResource, "nginx"), config)
+	if err == nil || !strings.Contains(err.Error(), "images not allowed in namespace testns: nginx") {
+		t.Errorf("Error: Wanted rejection of nginx, got %v", err)
+	}
+}
+
+func TestUnsupportedWorkloadSubresource(t *testing.T) {
+	request := workloadRequest(t, deploymentResource, "test")
+	request.SubResource = "scale"
+
+	res, err := manageImagePullSecrets(request, defaultConfig)
+	if err != nil || res.patches != nil {
+		t.Errorf("Wanted nil result and error, got %v, %v", res.patches, err)
+	}
+}
+
+// The pods of a workload are created by its controller, which is not on the allowlist, so even an allowlisted user
+// cannot set the preserve annotation on a pod template
+func TestWorkloadPreserveAnnotation(t *testing.T) {
+	req := templateRequest(t, deploymentResource, corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "testns",
+			Annotations: map[string]string{preserveSecretsAnnotation: "true"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "test"}}},
+	})
+	req.UserInfo.Username = "admin@example.com"
+
+	_, err := manageImagePullSecrets(req, overrideConfig)
+	if err == nil || !strings.Contains(err.Error(), "not allowed on the pod templates of deployments") {
+		t.Errorf("Error: Wanted rejected annotation, got %v", err)
+	}
+}
+
+// The pod template of a Job is immutable, so an update of a Job that no longer matches the rules is left alone
+func TestJobUpdateAdmission(t *testing.T) {
+	req := workloadRequest(t, jobResource, "test")
+	req.Operation = v1beta1.Update
+
+	res, err := manageImagePullSecrets(req, defaultConfig)
+	if err != nil {
+		t.Errorf("Error: Wanted nil, got %v", err)
+	}
+	if len(res.patches) != 0 {
+		t.Errorf("Result: Wanted no patch for the immutable template, got %v", res.patches)
+	}
+
+	if _, err := admitPodImages(req, imageAdmissionConfig); err != nil {
+		t.Errorf("Image admission: Wanted nil, got %v", err)
+	}
+
+	req.Operation = v1beta1.Create
+	if res, err := manageImagePullSecrets(req, defaultConfig); err != nil || len(res.patches) == 0 {
+		t.Errorf("Create: Wanted a patch, got %v and %v", res.patches, err)
+	}
+	if _, err := admitPodImages(req, imageAdmissionConfig); err == nil {
+		t.Errorf("Create: Wanted image rejected, got nil")
+	}
+}
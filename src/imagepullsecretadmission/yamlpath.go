@@ -0,0 +1,212 @@
+/*
+Copyright (c) 2019 Markus Lachinger. All rights reserved.
+Licensed under the MIT license. See LICENSE file in the project root for details.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Returned by yamlParent for a parent that cannot be determined
+const yamlUnresolved = -2
+
+var (
+	// Errors of the YAML decoder refer to a line of the document
+	yamlLineError = regexp.MustCompile(`^line (\d+): (.*)$`)
+	// and to Go types, which mean nothing to someone editing the config.
+	yamlUnknownField = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+	yamlInvalidValue = regexp.MustCompile("^cannot unmarshal !!\\w+ (`.*`|\\S+) into (\\S+)$")
+
+	yamlIdentifier = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+	// What the Go types of the config expect, for the errors of the YAML decoder
+	yamlTypeDescriptions = map[string]string{
+		"bool":          "a boolean",
+		"int":           "an integer",
+		"string":        "a string",
+		"time.Duration": "a duration",
+		"[]string":      "a list of strings",
+	}
+)
+
+// Rewrites an error of the YAML decoder, e.g. "line 5: field secret not found in type main.ImagePullSecretRule",
+// into the form of the other config errors, e.g. "rules[0].secret: unknown field". Errors that cannot be rewritten
+// are returned unchanged.
+func yamlErrorPath(content []byte, message string) string {
+	match := yamlLineError.FindStringSubmatch(message)
+	if match == nil {
+		return message
+	}
+	line, _ := strconv.Atoi(match[1])
+	problem := match[2]
+
+	if field := yamlUnknownField.FindStringSubmatch(problem); field != nil {
+		problem = "unknown field"
+	} else if value := yamlInvalidValue.FindStringSubmatch(problem); value != nil {
+		problem = fmt.Sprintf("invalid value %s", strings.Trim(value[1], "`"))
+		if description, ok := yamlTypeDescriptions[value[2]]; ok {
+			problem += ", must be " + description
+		}
+	}
+
+	path := yamlPath(content, line)
+	if path == "" {
+		return fmt.Sprintf("line %d: %s", line, problem)
+	}
+	return path + ": " + problem
+}
+
+// yamlLine is a line of a block style YAML document.
+type yamlLine struct {
+	// column of the first character, -1 for blank lines and comments
+	column int
+	// column of the "- " of a sequence item, -1 if the line does not start one
+	item int
+	// key of the line and its column, if it has one
+	key       string
+	keyColumn int
+	quoted    bool
+}
+
+func parseYAMLLine(text string) yamlLine {
+	line := yamlLine{column: -1, item: -1, keyColumn: -1}
+	trimmed := strings.TrimLeft(text, " ")
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+		return line
+	}
+	line.column = len(text) - len(trimmed)
+	line.keyColumn = line.column
+	if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+		line.item = line.column
+		rest := strings.TrimLeft(strings.TrimPrefix(trimmed, "-"), " ")
+		line.keyColumn = len(text) - len(rest)
+		trimmed = rest
+	}
+
+	if strings.HasPrefix(trimmed, `"`) || strings.HasPrefix(trimmed, `'`) {
+		quote := trimmed[:1]
+		end := strings.Index(trimmed[1:], quote)
+		if end >= 0 && strings.HasPrefix(trimmed[end+2:], ":") {
+			line.key, line.quoted = trimmed[1:end+1], true
+			if quote == `"` {
+				if unquoted, err := strconv.Unquote(trimmed[:end+2]); err == nil {
+					line.key = unquoted
+				}
+			}
+		}
+	} else if colon := strings.Index(trimmed, ":"); colon > 0 &&
+		(colon == len(trimmed)-1 || trimmed[colon+1] == ' ') && !strings.ContainsAny(trimmed[:colon], "[{") {
+		line.key = trimmed[:colon]
+	}
+	if line.key == "" {
+		line.keyColumn = -1
+	}
+	return line
+}
+
+// yamlPath returns the path of the key or sequence item on the line, e.g. excludedNamespaces[1].mode, or an empty
+// string if it cannot be determined. Only block style is followed, a line within a flow style collection resolves to
+// the key above it.
+func yamlPath(content []byte, line int) string {
+	texts := strings.Split(string(content), "\n")
+	if line < 1 || line > len(texts) {
+		return ""
+	}
+	lines := make([]yamlLine, len(texts))
+	for i, text := range texts {
+		lines[i] = parseYAMLLine(text)
+	}
+
+	// Starting at the line, every key and sequence item is followed up to its parent until the top level
+	i := line - 1
+	if lines[i].column < 0 {
+		return ""
+	}
+	item := lines[i].key == ""
+	if item && lines[i].item < 0 {
+		for i--; i >= 0 && lines[i].key == ""; i-- {
+		}
+		if i < 0 {
+			return ""
+		}
+		item = false
+	}
+
+	var path []string
+	for i >= 0 {
+		if !item {
+			path = append(path, yamlPathKey(lines[i]))
+			if lines[i].item >= 0 && lines[i].item < lines[i].keyColumn {
+				// The key is the first of a mapping in a sequence item
+				item = true
+				continue
+			}
+			i = yamlParent(lines, i, lines[i].keyColumn, &item, nil)
+			if i == yamlUnresolved {
+				return ""
+			}
+			continue
+		}
+
+		index := 0
+		i = yamlParent(lines, i, lines[i].item, &item, &index)
+		path = append(path, fmt.Sprintf("[%d]", index))
+		if i < 0 {
+			return ""
+		}
+	}
+
+	var joined strings.Builder
+	for k := len(path) - 1; k >= 0; k-- {
+		if joined.Len() > 0 && !strings.HasPrefix(path[k], "[") {
+			joined.WriteByte('.')
+		}
+		joined.WriteString(path[k])
+	}
+	return joined.String()
+}
+
+// yamlParent returns the line of the parent of the key or sequence item at column on line i, -1 at the top level, or
+// yamlUnresolved if the parent is not in block style.
+// item is set if the parent is a sequence item rather than a key. For a sequence item, the preceding items of the
+// same sequence are counted in index.
+func yamlParent(lines []yamlLine, i int, column int, item *bool, index *int) int {
+	for j := i - 1; j >= 0; j-- {
+		line := lines[j]
+		if line.column < 0 || line.column > column {
+			continue
+		}
+		if index != nil && line.column == column && line.item == column {
+			*index++
+			continue
+		}
+		if index == nil && line.item >= 0 && line.keyColumn == column {
+			// Another key of the mapping in the same sequence item
+			*item = true
+			return j
+		}
+		if line.column == column && index == nil {
+			continue
+		}
+		*item = line.key == ""
+		if *item && line.item < 0 {
+			return yamlUnresolved
+		}
+		return j
+	}
+	*item = false
+	return -1
+}
+
+// Keys of the config structure are written with a dot, other keys like regexes of a map in brackets.
+func yamlPathKey(line yamlLine) string {
+	if !line.quoted && yamlIdentifier.MatchString(line.key) {
+		return line.key
+	}
+	return fmt.Sprintf("[%q]", line.key)
+}
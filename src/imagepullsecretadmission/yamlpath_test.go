@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestYAMLPath(t *testing.T) {
+	const content = `application:
+  logLevel: info
+excludedNamespaces:
+- name: kube-system
+- regex: "^cert-manager$"
+  mode: ignore
+rules:
+  - name: team-a
+    namespaces: ["^team-a$"]
+    images:
+      - registry: gcr.io
+        tag: latest
+      - "^quay.io/"
+imagePullSecretRules:
+  "^team-b$":
+    ".*":
+    - "secret"
+# a comment
+
+secretSets:
+  gcr: [a,
+    b]
+`
+	tests := map[int]string{
+		1:  "application",
+		2:  "application.logLevel",
+		4:  "excludedNamespaces[0].name",
+		5:  "excludedNamespaces[1].regex",
+		6:  "excludedNamespaces[1].mode",
+		9:  "rules[0].namespaces",
+		12: "rules[0].images[0].tag",
+		13: "rules[0].images[1]",
+		16: `imagePullSecretRules["^team-b$"][".*"]`,
+		17: `imagePullSecretRules["^team-b$"][".*"][0]`,
+		18: "",
+		22: "secretSets.gcr",
+	}
+
+	for line, want := range tests {
+		if path := yamlPath([]byte(content), line); path != want {
+			t.Errorf("Line %d: Wanted '%s', got '%s'", line, want, path)
+		}
+	}
+}
+
+func TestYAMLErrorPath(t *testing.T) {
+	content := []byte("rules:\n- name: a\n  secret: b\napplication:\n  strictReload: maybe\n")
+	tests := map[string]string{
+		"line 3: field secret not found in type main.ImagePullSecretRule": "rules[0].secret: unknown field",
+		"line 5: cannot unmarshal !!str `maybe` into bool":                "application.strictReload: invalid value maybe, must be a boolean",
+		"line 9: cannot unmarshal !!str `x` into main.secretList":         "line 9: invalid value x",
+		"application.readTimeout: 5 is not a duration":                    "application.readTimeout: 5 is not a duration",
+	}
+
+	for message, want := range tests {
+		if got := yamlErrorPath(content, message); got != want {
+			t.Errorf("%s: Wanted '%s', got '%s'", message, want, got)
+		}
+	}
+}